@@ -0,0 +1,46 @@
+package wrapper
+
+import (
+	"fmt"
+	"net"
+)
+
+// WithListenBacklog sets the size of the queue of the TCP connections waiting to be accepted, for all the TCP listeners.
+// The operating system can cap it: on linux to the net.core.somaxconn sysctl, which is also the default size,
+// and on the BSDs and macOS to kern.ipc.somaxconn. It's not supported on windows.
+func WithListenBacklog(n int) SetFn {
+	return func(c *c) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid listen backlog %d", n)
+		}
+		c.backlog = n
+		return nil
+	}
+}
+
+// setListenBacklog changes the backlog of the TCP listeners, by listening again on their sockets
+func (c *c) setListenBacklog() error {
+	if c.backlog == 0 {
+		return nil
+	}
+	for _, l := range c.l {
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		raw, err := tl.SyscallConn()
+		if err != nil {
+			return err
+		}
+		var lerr error
+		if err := raw.Control(func(fd uintptr) {
+			lerr = listenBacklog(fd, c.backlog)
+		}); err != nil {
+			return err
+		}
+		if lerr != nil {
+			return fmt.Errorf("unable to set the backlog of listener %s: %w", l.Addr(), lerr)
+		}
+	}
+	return nil
+}
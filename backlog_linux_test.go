@@ -0,0 +1,48 @@
+package wrapper
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxBacklog returns the size of the accept queue of l, which linux reports in the sacked field
+// of the TCP_INFO of listening sockets
+func maxBacklog(t *testing.T, l net.Listener) int {
+	t.Helper()
+	raw, err := l.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatalf("unable to get the socket of the listener: %s", err)
+	}
+	var info *unix.TCPInfo
+	cerr := raw.Control(func(fd uintptr) {
+		info, err = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if cerr != nil || err != nil {
+		t.Fatalf("unable to get the TCP_INFO of the listener: %v %v", cerr, err)
+	}
+	return int(info.Sacked)
+}
+
+func TestWithListenBacklog(t *testing.T) {
+	const backlog = 2
+
+	srv, err := NewServer(HTTP("127.0.0.1:0"), WithListenBacklog(backlog))
+	if err != nil {
+		t.Fatalf("NewServer returned %s", err)
+	}
+	defer srv.c.closeListeners()
+	if n := maxBacklog(t, srv.c.l[0]); n != backlog {
+		t.Errorf("the listener has a backlog of %d, expected %d", n, backlog)
+	}
+
+	// without it, the backlog is the one set by the net package
+	c := configure(t)
+	if n := maxBacklog(t, c.l[0]); n == backlog {
+		t.Errorf("the listener has a backlog of %d without WithListenBacklog", n)
+	}
+	if _, err := NewServer(HTTP("127.0.0.1:0"), WithListenBacklog(0)); err == nil {
+		t.Errorf("NewServer succeeded with an invalid backlog")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package wrapper
+
+import "fmt"
+
+func listenBacklog(uintptr, int) error {
+	return fmt.Errorf("changing the listen backlog is not supported on this platform")
+}
@@ -0,0 +1,10 @@
+//go:build unix
+
+package wrapper
+
+import "syscall"
+
+// listenBacklog calls listen on an already listening socket, which only updates its backlog
+func listenBacklog(fd uintptr, n int) error {
+	return syscall.Listen(int(fd), n)
+}
@@ -17,11 +17,12 @@ const (
 )
 
 func wait() error {
-	ctx, _ := context.WithTimeout(context.Background(), RunTime)
+	ctx, cancelFn := context.WithTimeout(context.Background(), RunTime)
+	defer cancelFn()
 
-	go func () {
+	go func() {
 		select {
-		case <- ctx.Done():
+		case <-ctx.Done():
 			fmt.Println()
 			if err := ctx.Err(); err != nil {
 				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
@@ -41,52 +42,44 @@ func wait() error {
 		time.Sleep(WaitTime)
 		fmt.Printf("\r")
 	}
-	return nil
 }
 
 func main() {
 	l := log.New(os.Stdout, "", 0)
-	os.Exit(wrapper.RegisterSignalHandlers(
-		wrapper.SignalHandlers{
-			syscall.SIGHUP: func(_ chan int) {
-				fmt.Fprintln(l.Writer())
-				l.SetPrefix("SIGHUP ")
-				l.Printf("reloading config")
-			},
-			syscall.SIGUSR1: func(_ chan int) {
-				fmt.Fprintln(l.Writer())
-				l.SetPrefix("SIGUSR1 ")
-				l.Printf("performing maintenance task #1")
-			},
-			syscall.SIGUSR2: func(_ chan int) {
-				fmt.Fprintln(l.Writer())
-				l.SetPrefix("SIGUSR2 ")
-				l.Printf("performing maintenance task #2")
-			},
-			syscall.SIGTERM: func(exit chan int) {
-				// kill -SIGTERM XXXX
-				fmt.Fprintln(l.Writer())
-				l.SetPrefix("SIGTERM ")
-				l.Printf("stopping")
-				exit <- 0
-			},
-			syscall.SIGINT: func(exit chan int) {
-				// kill -SIGINT XXXX or Ctrl+c
-				l.SetPrefix("SIGINT ")
-				fmt.Fprintln(l.Writer())
-				l.Printf("stopping gracefully")
-				fmt.Fprintf(l.Writer(), "\nHere we can gracefully close things (waiting 3s)\n")
-				time.Sleep(3*time.Second)
-				exit <- 0
-				fmt.Fprintln(l.Writer())
-			},
-			syscall.SIGQUIT: func(exit chan int) {
-				l.SetPrefix("SIGQUIT ")
-				l.SetOutput(os.Stderr)
-				fmt.Fprintln(l.Writer())
-				l.Printf("force stopping")
-				exit <- -1
-			},
+	handlers := wrapper.SignalHandlers{
+		syscall.SIGHUP: func(_ chan int) {
+			fmt.Fprintln(l.Writer())
+			l.SetPrefix("SIGHUP ")
+			l.Printf("reloading config")
 		},
-	).Exec(wait))
+		syscall.SIGTERM: func(exit chan int) {
+			// kill -SIGTERM XXXX
+			fmt.Fprintln(l.Writer())
+			l.SetPrefix("SIGTERM ")
+			l.Printf("stopping")
+			exit <- 0
+		},
+		syscall.SIGINT: func(exit chan int) {
+			// kill -SIGINT XXXX or Ctrl+c
+			l.SetPrefix("SIGINT ")
+			fmt.Fprintln(l.Writer())
+			l.Printf("stopping gracefully")
+			fmt.Fprintf(l.Writer(), "\nHere we can gracefully close things (waiting 3s)\n")
+			time.Sleep(3 * time.Second)
+			exit <- 0
+			fmt.Fprintln(l.Writer())
+		},
+		syscall.SIGQUIT: func(exit chan int) {
+			l.SetPrefix("SIGQUIT ")
+			l.SetOutput(os.Stderr)
+			fmt.Fprintln(l.Writer())
+			l.Printf("force stopping")
+			exit <- -1
+		},
+	}
+	// the maintenance signals are not available on all platforms
+	for sig, fn := range maintenanceHandlers(l) {
+		handlers[sig] = fn
+	}
+	os.Exit(wrapper.RegisterSignalHandlers(handlers).Exec(wait))
 }
@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"syscall"
+
+	"git.sr.ht/~mariusor/wrapper"
+)
+
+func maintenanceHandlers(l *log.Logger) wrapper.SignalHandlers {
+	return wrapper.SignalHandlers{
+		syscall.SIGUSR1: func(_ chan int) {
+			fmt.Fprintln(l.Writer())
+			l.SetPrefix("SIGUSR1 ")
+			l.Printf("performing maintenance task #1")
+		},
+		syscall.SIGUSR2: func(_ chan int) {
+			fmt.Fprintln(l.Writer())
+			l.SetPrefix("SIGUSR2 ")
+			l.Printf("performing maintenance task #2")
+		},
+	}
+}
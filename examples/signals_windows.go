@@ -0,0 +1,12 @@
+package main
+
+import (
+	"log"
+
+	"git.sr.ht/~mariusor/wrapper"
+)
+
+// maintenanceHandlers returns no handlers, as windows doesn't have the SIGUSR1 and SIGUSR2 signals
+func maintenanceHandlers(_ *log.Logger) wrapper.SignalHandlers {
+	return wrapper.SignalHandlers{}
+}
@@ -0,0 +1,36 @@
+//go:build unix
+
+package wrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// ForwardTo returns the handlers that send sigs to the process pid, or to the process group -pid, if pid is negative,
+// for the wrapper to act as the supervisor of a child process.
+// The processes that have already exited are ignored, any other error ends the execution.
+// SIGKILL and SIGSTOP can't be forwarded, as they never get to the handlers.
+func ForwardTo(pid int, sigs ...os.Signal) SimpleHandlers {
+	handlers := make(SimpleHandlers, len(sigs))
+	for _, sig := range sigs {
+		handlers[sig] = forward(pid, sig)
+	}
+	return handlers
+}
+
+func forward(pid int, sig os.Signal) simpleHandlerFn {
+	return func(context.Context) error {
+		s, ok := sig.(syscall.Signal)
+		if !ok {
+			return fmt.Errorf("unable to forward signal %s", sig)
+		}
+		if err := syscall.Kill(pid, s); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("unable to forward %s to %d: %w", sig, pid, err)
+		}
+		return nil
+	}
+}
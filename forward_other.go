@@ -0,0 +1,22 @@
+//go:build !unix
+
+package wrapper
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// ForwardTo returns handlers for sigs which end the execution with an error, as sending signals
+// to other processes is not supported on this platform.
+func ForwardTo(pid int, sigs ...os.Signal) SimpleHandlers {
+	handlers := make(SimpleHandlers, len(sigs))
+	for _, sig := range sigs {
+		sig := sig
+		handlers[sig] = func(context.Context) error {
+			return fmt.Errorf("unable to forward %s to %d: not supported on this platform", sig, pid)
+		}
+	}
+	return handlers
+}
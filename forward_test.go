@@ -0,0 +1,77 @@
+//go:build unix
+
+package wrapper
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestForwardTo(t *testing.T) {
+	// the child runs in its own process group, and reports the signals it receives
+	cmd := exec.Command("/bin/sh", "-c", `trap 'echo hup' HUP; trap 'echo term; exit 0' TERM; echo ready; while :; do sleep 0.01; done`)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("unable to get the output of the child process: %s", err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatalf("unable to start the child process: %s", err)
+	}
+	defer cmd.Process.Kill()
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		for sc := bufio.NewScanner(stdout); sc.Scan(); {
+			lines <- sc.Text()
+		}
+	}()
+	expect := func(line string) {
+		t.Helper()
+		select {
+		case l := <-lines:
+			if l != line {
+				t.Fatalf("the child process printed %q, expected %q", l, line)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("the child process didn't print %q in %s", line, testTimeout)
+		}
+	}
+	expect("ready")
+
+	pid := cmd.Process.Pid
+	handlers := ForwardTo(pid, syscall.SIGTERM)
+	for sig, fn := range ForwardTo(-pid, syscall.SIGHUP) {
+		handlers[sig] = fn
+	}
+	src := make(chan os.Signal)
+	ctx, cancelFn := context.WithCancel(context.Background())
+	done := execAsync(RegisterSimpleHandlers(handlers, WithSignalSource(src)), ctx, waitCtx)
+
+	send(t, src, syscall.SIGHUP)
+	expect("hup")
+	send(t, src, syscall.SIGTERM)
+	expect("term")
+	if err = cmd.Wait(); err != nil {
+		t.Errorf("the child process failed: %s", err)
+	}
+
+	// the signals for the child that has exited are ignored
+	send(t, src, syscall.SIGTERM)
+	send(t, src, syscall.SIGHUP)
+	select {
+	case err = <-done:
+		t.Fatalf("the execution ended with %v after forwarding to a process that has exited", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancelFn()
+	if err = result(t, done); !errors.Is(err, context.Canceled) {
+		t.Errorf("ExecContext returned %v, expected %v", err, context.Canceled)
+	}
+}
@@ -1,3 +1,12 @@
 module git.sr.ht/~mariusor/wrapper
 
-go 1.15
+go 1.20
+
+require (
+	golang.org/x/crypto v0.17.0
+	golang.org/x/net v0.10.0
+	golang.org/x/sys v0.15.0
+	golang.org/x/time v0.5.0
+)
+
+require golang.org/x/text v0.14.0 // indirect
@@ -2,78 +2,854 @@ package wrapper
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
+	"log"
+	"math/big"
 	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/netutil"
 )
 
-func fileExists(dir string) bool {
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		return false
+// checkFile returns an error if the file at path can't be read, because it doesn't exist, it's not accessible
+// or it's a directory
+func checkFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
 	}
-	return true
+	if fi.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return nil
 }
 
 type (
 	c struct {
-		h        http.Handler
-		l        net.Listener
-		wTimeOut time.Duration
-		cert     string
-		key      string
-		addr     string
+		s       *http.Server
+		l       []net.Listener
+		cert    string
+		key     string
+		readyFn func([]net.Addr)
+		// readyCh gets closed when the server starts serving
+		readyCh chan<- struct{}
+		// gWait is the maximum duration to wait for the requests in progress when stopping
+		gWait time.Duration
+		// drainDelay is the duration the server keeps accepting connections after it's been marked as not ready
+		drainDelay time.Duration
+		// shutdownTimeout is the duration after GracefulWait after which the connections still active get closed
+		shutdownTimeout time.Duration
+		// notify is set when systemd needs to be notified about the server's state
+		notify bool
+		// watchdog is the interval for pinging the systemd watchdog
+		watchdog time.Duration
+		// done is closed when the server stops, to end the background goroutines
+		done     chan struct{}
+		doneOnce sync.Once
+		// bgM guards starting the background goroutines against the server stopping at the same time
+		bgM sync.Mutex
+		// stopOnce makes the graceful shutdown happen once, when a listener fails and when the server gets stopped
+		stopOnce sync.Once
+		// bg tracks the background goroutines
+		bg sync.WaitGroup
+		// base is the base context of the requests
+		base *graceContext
+		// wrap are functions that get applied to the server's handler, in order
+		wrap []func(http.Handler) http.Handler
+		// ocspStaples are the OCSP responses to staple, and ocspRefresh the interval to fetch them at,
+		// which are used by the ocsp stapler to serve the certificates
+		ocspStaples [][]byte
+		ocspRefresh time.Duration
+		ocsp        *stapler
+		// ticketRotation is the interval at which tickets replaces the TLS session ticket keys
+		ticketRotation time.Duration
+		tickets        *ticketRotator
+		// stopping is set when the shutdown starts
+		stopping atomic.Bool
+		// baseFn returns the context holding the values for the requests received on a listener
+		baseFn func(net.Listener) context.Context
+		// onShutdown are called at the end of the shutdown
+		onShutdown []func(context.Context) error
+		// logf logs the lifecycle of the server
+		logf func(string, ...interface{})
+		// raw are the listeners in l before being wrapped
+		raw []net.Listener
+		// tls holds the indexes in l of the listeners that serve TLS
+		tls map[int]bool
+		// wrapListener are functions that get applied to the listeners of the main server, in order
+		wrapListener []func(net.Listener) net.Listener
+		// backlog is the size of the accept queue of the TCP listeners
+		backlog int
+		// trusted replaces the remote address of the requests with the one forwarded by trusted proxies,
+		// it wraps the handler after wrap, so all of them get the client address
+		trusted func(http.Handler) http.Handler
+		// serverFns are functions that modify the server after it has been configured
+		serverFns []func(*http.Server)
+		// h2c is set when HTTP/2 needs to be served on plain text connections
+		h2c bool
+		// alpn are the handlers for the protocols, other than HTTP, negotiated on the TLS connections
+		alpn      map[string]func(*tls.Conn)
+		alpnOrder []string
+		// noHTTP2 is set when HTTP/2 must not be negotiated on the TLS connections
+		noHTTP2 bool
+		// services are the servers for other protocols, like HTTP/3, which share the lifecycle of the server
+		services []Service
+		// udp are the UDP connections served by their own handlers
+		udp []udpService
+		// udpCtx is the context of the UDP handlers, canceled before their connections get closed
+		udpCtx    context.Context
+		udpCancel context.CancelFunc
+		// conns tracks the state of the server's connections
+		conns connTracker
+		// aux are plain HTTP listeners with their own handlers, which share the lifecycle of the main server
+		aux []auxServer
 	}
 	SetFn func(*c) error
+
+	auxServer struct {
+		l net.Listener
+		h http.Handler
+		s *http.Server
+	}
 )
 
 func WriteWait(d time.Duration) SetFn {
 	return func(c *c) error {
-		c.wTimeOut = d
+		c.s.WriteTimeout = d
+		return nil
+	}
+}
+
+// GracefulWait sets the maximum duration to wait for the requests in progress to finish when the server stops,
+// after which their contexts get canceled. It's not a fixed delay: the stop function returns as soon as
+// all the connections are idle.
+func GracefulWait(d time.Duration) SetFn {
+	return func(c *c) error {
+		c.gWait = d
+		return nil
+	}
+}
+
+// WithShutdownTimeout bounds the shutdown to d after GracefulWait, giving the requests which are still
+// in progress when their contexts get canceled d to return, after which their connections get closed,
+// and the stop function returns a ShutdownError. Unlike with GracefulWait alone, which leaves those
+// connections open, the shutdown is guaranteed to end, in at most GracefulWait plus d.
+// Without GracefulWait, the contexts of the requests get canceled as soon as the shutdown starts.
+func WithShutdownTimeout(d time.Duration) SetFn {
+	return func(c *c) error {
+		if d <= 0 {
+			return fmt.Errorf("invalid shutdown timeout %s", d)
+		}
+		c.shutdownTimeout = d
+		return nil
+	}
+}
+
+// WithDrainDelay makes the server keep serving for d after it's been marked as not ready, before it closes
+// its listeners and starts draining the requests in progress, so the load balancers checking
+// the readiness endpoint of WithHealthEndpoints stop sending it new requests in the meantime.
+// GracefulWait starts after the delay.
+func WithDrainDelay(d time.Duration) SetFn {
+	return func(c *c) error {
+		if d <= 0 {
+			return fmt.Errorf("invalid drain delay %s", d)
+		}
+		c.drainDelay = d
+		return nil
+	}
+}
+
+// ReadWait sets the maximum duration for reading the entire request
+func ReadWait(d time.Duration) SetFn {
+	return func(c *c) error {
+		c.s.ReadTimeout = d
+		return nil
+	}
+}
+
+// ReadHeaderWait sets the maximum duration for reading the request headers
+func ReadHeaderWait(d time.Duration) SetFn {
+	return func(c *c) error {
+		c.s.ReadHeaderTimeout = d
+		return nil
+	}
+}
+
+// IdleWait sets the maximum duration to wait for the next request on a keep-alive connection
+func IdleWait(d time.Duration) SetFn {
+	return func(c *c) error {
+		c.s.IdleTimeout = d
+		return nil
+	}
+}
+
+// MaxHeaderBytes sets the maximum size of the request headers, zero meaning the http package default
+func MaxHeaderBytes(n int) SetFn {
+	return func(c *c) error {
+		if n < 0 {
+			return fmt.Errorf("invalid max header bytes value %d", n)
+		}
+		c.s.MaxHeaderBytes = n
 		return nil
 	}
 }
 
 func HTTP(addr string) SetFn {
-	return func(c *c) (err error) {
+	return OnTCPWithConfig(addr, net.ListenConfig{})
+}
+
+// OnTCPWithConfig listens on the TCP address addr, using lc for creating the listener,
+// which allows setting socket options through its Control function.
+func OnTCPWithConfig(addr string, lc net.ListenConfig) SetFn {
+	return onTCP("tcp", addr, lc)
+}
+
+// OnTCP4 listens only on the IPv4 TCP address addr
+func OnTCP4(addr string) SetFn {
+	return onTCP("tcp4", addr, net.ListenConfig{})
+}
+
+// OnTCP6 listens only on the IPv6 TCP address addr
+func OnTCP6(addr string) SetFn {
+	return onTCP("tcp6", addr, net.ListenConfig{})
+}
+
+func onTCP(network, addr string, lc net.ListenConfig) SetFn {
+	return func(c *c) error {
 		if addr == "" {
 			addr = ":http"
 		}
-		c.addr = addr
-		c.l, err = net.Listen("tcp", c.addr)
-		return
+		c.s.Addr = addr
+		l, err := listenTCP(lc, network, addr)
+		if err != nil {
+			return err
+		}
+		c.l = append(c.l, l)
+		return nil
+	}
+}
+
+// listenTCP checks addr before listening on it, so the error for an obvious mistake is clearer than the one of net.Listen
+func listenTCP(lc net.ListenConfig, network, addr string) (net.Listener, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("OnTCP: invalid address %q: %w", addr, err)
+	}
+	if _, err := net.LookupPort(network, port); err != nil {
+		return nil, fmt.Errorf("OnTCP: invalid port in address %q: %w", addr, err)
+	}
+	l, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("OnTCP: unable to listen on %q: %w", addr, err)
+	}
+	return l, nil
+}
+
+// OnTCPAddrs listens on all the TCP addresses in addrs.
+// If any of them fails, the listeners already created by it are closed.
+func OnTCPAddrs(addrs ...string) SetFn {
+	return func(c *c) error {
+		listeners := make([]net.Listener, 0, len(addrs))
+		for _, addr := range addrs {
+			if addr == "" {
+				addr = ":http"
+			}
+			l, err := listenTCP(net.ListenConfig{}, "tcp", addr)
+			if err != nil {
+				for _, l := range listeners {
+					l.Close()
+				}
+				return err
+			}
+			listeners = append(listeners, l)
+		}
+		c.l = append(c.l, listeners...)
+		return nil
 	}
 }
 
 func HTTPS(addr, cert, key string) SetFn {
-	if !fileExists(cert) {
-		return func(*c) error { return fmt.Errorf("invalid certificate file %q", cert) }
+	if err := checkFile(cert); err != nil {
+		return func(*c) error { return fmt.Errorf("invalid certificate file %q: %w", cert, err) }
 	}
-	if !fileExists(key){
-		return func(*c) error { return fmt.Errorf("invalid key file %q", key) }
+	if err := checkFile(key); err != nil {
+		return func(*c) error { return fmt.Errorf("invalid key file %q: %w", key, err) }
 	}
-	return func(c *c) (err error) {
+	return func(c *c) error {
 		if addr == "" {
 			addr = ":https"
 		}
-		c.l, err = net.Listen("tcp", addr)
-		return
+		c.s.Addr = addr
+		if c.cert != "" && (c.cert != cert || c.key != key) {
+			// the certificate of a previous HTTPS call is kept, the one matching the requested server name gets used
+			crt, err := tls.LoadX509KeyPair(cert, key)
+			if err != nil {
+				return fmt.Errorf("unable to load certificate %q: %w", cert, err)
+			}
+			if err = WithCertificate(crt)(c); err != nil {
+				return err
+			}
+		} else {
+			c.cert = cert
+			c.key = key
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		c.l = append(c.l, l)
+		c.markTLS(len(c.l) - 1)
+		return nil
 	}
 }
 
-func Handler(h http.Handler) SetFn {
+// WithTLS makes the listeners created by fn serve TLS, using the certificates set up by HTTPS, WithCertificate
+// or any of the other TLS SetFns. All the other listeners, except the ones created by HTTPS, serve plaintext.
+func WithTLS(fn SetFn) SetFn {
 	return func(c *c) error {
-		c.h = h
+		n := len(c.l)
+		if err := fn(c); err != nil {
+			return err
+		}
+		if len(c.l) == n {
+			return fmt.Errorf("WithTLS: no listener has been created")
+		}
+		for i := n; i < len(c.l); i++ {
+			c.markTLS(i)
+		}
 		return nil
 	}
 }
 
-func Socket() SetFn {
-	return func (c *c) (err error) {
-		c.l, err = net.FileListener(os.NewFile(3, "from systemd"))
-		return
+func (c *c) markTLS(i int) {
+	if c.tls == nil {
+		c.tls = make(map[int]bool)
+	}
+	c.tls[i] = true
+}
+
+// WithListener adds an already created listener to the server
+func WithListener(l net.Listener) SetFn {
+	return func(c *c) error {
+		if l == nil {
+			return fmt.Errorf("invalid nil listener")
+		}
+		c.l = append(c.l, l)
+		return nil
+	}
+}
+
+// OnSocket listens on the unix domain socket at path.
+// The socket file is removed when the server stops.
+// On linux a path starting with "@" creates an abstract socket, which has no corresponding file.
+func OnSocket(path string) SetFn {
+	return func(c *c) error {
+		l, err := listenUnix(path)
+		if err != nil {
+			return err
+		}
+		c.l = append(c.l, l)
+		return nil
+	}
+}
+
+func isAbstractSocket(path string) bool {
+	return len(path) > 0 && path[0] == '@'
+}
+
+// listenUnix creates a unix domain socket listener that removes its socket file when closed, which
+// the net package does by default for the listeners it creates.
+// This is different from the sockets received from systemd, which are managed by it, and from
+// abstract sockets, which the net package never tries to remove.
+func listenUnix(path string) (*net.UnixListener, error) {
+	return net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+}
+
+// OnSocketMode listens on the unix domain socket at path, and changes its file mode to mode.
+// The mode is set after the socket file gets created, so for a short time it has the permissions
+// resulting from the process' umask. If that is an issue, the socket should be created in
+// a directory with restricted access.
+func OnSocketMode(path string, mode os.FileMode) SetFn {
+	return func(c *c) error {
+		l, err := listenUnix(path)
+		if err != nil {
+			return err
+		}
+		if isAbstractSocket(path) {
+			// abstract sockets don't have file permissions
+			c.l = append(c.l, l)
+			return nil
+		}
+		if err = os.Chmod(path, mode); err != nil {
+			l.Close()
+			return fmt.Errorf("unable to change mode for socket %q: %w", path, err)
+		}
+		c.l = append(c.l, l)
+		return nil
+	}
+}
+
+// WithTLSConfig replaces the default TLS configuration of the server.
+// The certificate and key passed to HTTPS are used only if cfg doesn't already have
+// Certificates or a GetCertificate function set.
+// The server uses a copy of cfg, so the same configuration can be passed to multiple servers.
+func WithTLSConfig(cfg *tls.Config) SetFn {
+	return func(c *c) error {
+		if cfg == nil {
+			return fmt.Errorf("invalid nil TLS configuration")
+		}
+		c.s.TLSConfig = cfg.Clone()
+		return nil
+	}
+}
+
+// WithReadyCallback sets a function that receives the addresses the listeners have been bound to,
+// which is useful for finding out the port assigned by the OS when listening on ":0".
+// The unix socket listeners report a *net.UnixAddr, with the path of the socket, or its "@" prefixed name
+// for abstract sockets.
+func WithReadyCallback(fn func([]net.Addr)) SetFn {
+	return func(c *c) error {
+		c.readyFn = fn
+		return nil
+	}
+}
+
+// WithCertificate adds an in memory certificate to the TLS configuration of the server.
+// It can be called multiple times, for serving different host names: the certificate used for a connection
+// is the one matching the server name requested by the client, or the first one when none does.
+func WithCertificate(cert tls.Certificate) SetFn {
+	return func(c *c) error {
+		if cert.Leaf == nil && len(cert.Certificate) > 0 {
+			// crypto/tls would otherwise parse the certificate on every handshake, for matching it to the server name
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return fmt.Errorf("invalid certificate: %w", err)
+			}
+			cert.Leaf = leaf
+		}
+		c.s.TLSConfig.Certificates = append(c.s.TLSConfig.Certificates, cert)
+		return nil
+	}
+}
+
+// WithCertPEM adds a certificate from PEM encoded data to the TLS configuration of the server
+func WithCertPEM(certPEM, keyPEM []byte) SetFn {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return func(*c) error { return fmt.Errorf("invalid PEM certificate: %w", err) }
+	}
+	return WithCertificate(cert)
+}
+
+// WithSelfSignedCert adds a self signed certificate, valid for one day for hosts, to the TLS configuration of the server.
+// When no hosts are passed, the certificate is valid for "localhost" and "127.0.0.1".
+// It is intended for local development and tests.
+func WithSelfSignedCert(hosts ...string) SetFn {
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1"}
+	}
+	cert, err := selfSignedCert(hosts, 24*time.Hour)
+	if err != nil {
+		return func(*c) error { return fmt.Errorf("unable to generate self signed certificate: %w", err) }
+	}
+	return WithCertificate(cert)
+}
+
+func selfSignedCert(hosts []string, validity time.Duration) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"wrapper self signed"}},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tpl.IPAddresses = append(tpl.IPAddresses, ip)
+		} else {
+			tpl.DNSNames = append(tpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tpl, &tpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// WithClientCAs sets the certificate authorities used to verify the client certificates
+func WithClientCAs(pool *x509.CertPool) SetFn {
+	return func(c *c) error {
+		c.s.TLSConfig.ClientCAs = pool
+		return nil
+	}
+}
+
+// WithClientCAFile loads the certificate authorities used to verify the client certificates from a PEM file
+func WithClientCAFile(path string) SetFn {
+	return func(c *c) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("unable to read client CA file %q: %w", path, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no valid certificates found in client CA file %q", path)
+		}
+		c.s.TLSConfig.ClientCAs = pool
+		return nil
+	}
+}
+
+// WithClientAuth sets the policy the server follows for client certificates,
+// the verified certificates are available to the handlers in the request's TLS.PeerCertificates
+func WithClientAuth(auth tls.ClientAuthType) SetFn {
+	return func(c *c) error {
+		c.s.TLSConfig.ClientAuth = auth
+		return nil
+	}
+}
+
+// WithAutocert sets up the server to obtain its certificates from Let's Encrypt, for the hosts accepted by hostPolicy.
+// The certificates are stored in cacheDir, which gets created if it doesn't exist.
+// The handler answers the HTTP-01 challenges for requests on plain HTTP listeners.
+func WithAutocert(hostPolicy autocert.HostPolicy, cacheDir string) SetFn {
+	return func(c *c) error {
+		if err := os.MkdirAll(cacheDir, 0700); err != nil {
+			return fmt.Errorf("unable to create certificate cache directory %q: %w", cacheDir, err)
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: hostPolicy,
+			Cache:      autocert.DirCache(cacheDir),
+		}
+		c.s.TLSConfig.GetCertificate = m.GetCertificate
+		c.s.TLSConfig.NextProtos = append(c.s.TLSConfig.NextProtos, acme.ALPNProto)
+		c.wrap = append(c.wrap, m.HTTPHandler)
+		return nil
+	}
+}
+
+// WithErrorLog sets the logger for the errors encountered by the server, like failed TLS handshakes
+func WithErrorLog(l *log.Logger) SetFn {
+	return func(c *c) error {
+		c.s.ErrorLog = l
+		return nil
+	}
+}
+
+// LogFnLogger returns a logger which passes every line it receives to fn,
+// for routing the server's errors to other logging packages.
+func LogFnLogger(fn func(string, ...interface{})) *log.Logger {
+	return log.New(logFnWriter(fn), "", 0)
+}
+
+// WithLogf logs the addresses the server listens on, and the start and the end of its shutdown, using fn.
+// By default nothing is logged.
+func WithLogf(fn func(string, ...interface{})) SetFn {
+	return func(c *c) error {
+		if fn == nil {
+			fn = nopLogFn
+		}
+		c.logf = fn
+		return nil
+	}
+}
+
+type logFnWriter func(string, ...interface{})
+
+func (w logFnWriter) Write(p []byte) (int, error) {
+	w("%s", strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// WithH2C enables HTTP/2 over plain text connections, both with prior knowledge and through the upgrade mechanism.
+// The TLS listeners negotiate HTTP/2 as before.
+func WithH2C() SetFn {
+	return func(c *c) error {
+		c.h2c = true
+		return nil
+	}
+}
+
+// WithoutHTTP2 disables HTTP/2 on the TLS listeners, so all the clients use HTTP/1.1.
+func WithoutHTTP2() SetFn {
+	return func(c *c) error {
+		c.noHTTP2 = true
+		return nil
+	}
+}
+
+// WithALPN makes the TLS listeners negotiate protos with the clients, in order of preference, before HTTP/2 and HTTP/1.1.
+// The connections that negotiate one of them are passed to its handler, and they get closed when it returns.
+// A protocol without a handler, like "h2" or "http/1.1", is only moved before the others.
+func WithALPN(protos []string, handlers map[string]func(*tls.Conn)) SetFn {
+	return func(c *c) error {
+		for p, fn := range handlers {
+			if fn == nil {
+				return fmt.Errorf("nil handler for protocol %q", p)
+			}
+			if !hasProto(protos, p) {
+				return fmt.Errorf("protocol %q has a handler, but it's not negotiated", p)
+			}
+		}
+		if c.alpn == nil {
+			c.alpn = make(map[string]func(*tls.Conn))
+		}
+		for p, fn := range handlers {
+			c.alpn[p] = fn
+		}
+		c.alpnOrder = append(c.alpnOrder, protos...)
+		return nil
+	}
+}
+
+// configureALPN sets up the protocols of WithALPN, it's done after the setters, as they can replace
+// the TLS configuration
+func (c *c) configureALPN() error {
+	if len(c.alpnOrder) == 0 && len(c.alpn) == 0 {
+		return nil
+	}
+	if c.s.TLSNextProto == nil {
+		// setting TLSNextProto disables the HTTP/2 support of the server, unless it's been configured explicitly
+		if err := http2.ConfigureServer(c.s, &http2.Server{}); err != nil {
+			return err
+		}
+	}
+	for p, fn := range c.alpn {
+		fn := fn
+		c.s.TLSNextProto[p] = func(_ *http.Server, conn *tls.Conn, _ http.Handler) {
+			fn(conn)
+		}
+	}
+	protos := append([]string{}, c.alpnOrder...)
+	for _, p := range c.s.TLSConfig.NextProtos {
+		if !hasProto(protos, p) {
+			protos = append(protos, p)
+		}
+	}
+	if !hasProto(protos, "http/1.1") {
+		protos = append(protos, "http/1.1")
+	}
+	c.s.TLSConfig.NextProtos = protos
+	return nil
+}
+
+// WithMaxConns limits the number of simultaneous connections accepted by each listener to n.
+// When the limit is reached, new connections wait until one of the existing ones gets closed.
+func WithMaxConns(n int) SetFn {
+	return func(c *c) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid max connections value %d", n)
+		}
+		c.wrapListener = append(c.wrapListener, func(l net.Listener) net.Listener {
+			return netutil.LimitListener(l, n)
+		})
+		return nil
+	}
+}
+
+// WithTCPKeepAlive sets the keep-alive period for the connections accepted by TCP listeners, zero disabling keep-alives.
+func WithTCPKeepAlive(d time.Duration) SetFn {
+	return func(c *c) error {
+		if d < 0 {
+			return fmt.Errorf("invalid keep-alive period %s", d)
+		}
+		// this needs to be the innermost wrapper, as it works only on the TCP connections themselves
+		c.wrapListener = append([]func(net.Listener) net.Listener{func(l net.Listener) net.Listener {
+			return &keepAliveListener{Listener: l, period: d}
+		}}, c.wrapListener...)
+		return nil
+	}
+}
+
+type keepAliveListener struct {
+	net.Listener
+	period time.Duration
+}
+
+func (l *keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return conn, nil
+	}
+	if l.period == 0 {
+		tc.SetKeepAlive(false)
+		return tc, nil
+	}
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(l.period)
+	return tc, nil
+}
+
+// WithBaseContext makes the values of the context returned by fn for a listener available to the requests
+// received on it. The requests' contexts still get canceled at the end of the graceful shutdown,
+// and have its deadline, as the cancellation and the deadline of the context returned by fn are ignored.
+func WithBaseContext(fn func(net.Listener) context.Context) SetFn {
+	return func(c *c) error {
+		if fn == nil {
+			return fmt.Errorf("nil base context function")
+		}
+		c.baseFn = fn
+		return nil
+	}
+}
+
+// WithConnContext sets fn to modify the context of every new connection, which is used by all its requests.
+// The context fn receives derives from the WithBaseContext one.
+// fn is called before the server starts serving the connection in a goroutine of its own, so it should not block.
+// With WithProxyProtocol this includes calling the connection's RemoteAddr method, which waits for the PROXY header.
+func WithConnContext(fn func(ctx context.Context, c net.Conn) context.Context) SetFn {
+	return func(c *c) error {
+		c.s.ConnContext = fn
+		return nil
+	}
+}
+
+// WithOnShutdown adds fn to the functions called at the end of the shutdown, after the connections
+// have been drained and the listeners closed, even if that failed. Their errors are returned by the stop function.
+func WithOnShutdown(fn func(context.Context) error) SetFn {
+	return func(c *c) error {
+		if fn == nil {
+			return fmt.Errorf("nil shutdown function")
+		}
+		c.onShutdown = append(c.onShutdown, fn)
+		return nil
+	}
+}
+
+// WithRegisterOnShutdown adds fn to the functions called when the shutdown starts, which is how the hijacked
+// and the long-lived connections, like websockets, find out they need to close, as the shutdown doesn't wait for them.
+// Unlike WithOnShutdown, fn gets called in a goroutine of its own, without the shutdown waiting for it to return.
+func WithRegisterOnShutdown(fn func()) SetFn {
+	return func(c *c) error {
+		if fn == nil {
+			return fmt.Errorf("nil shutdown function")
+		}
+		c.s.RegisterOnShutdown(fn)
+		return nil
+	}
+}
+
+// WithServerOptions allows modifying the http.Server directly, for the settings that don't have a SetFn.
+// fn is called after all the other SetFns have been applied, so it can override them.
+func WithServerOptions(fn func(*http.Server)) SetFn {
+	return func(c *c) error {
+		c.serverFns = append(c.serverFns, fn)
+		return nil
+	}
+}
+
+// WithHTTPRedirect listens on the plain HTTP address addr, and permanently redirects all the requests it receives
+// to the same host, path and query on https.
+func WithHTTPRedirect(addr string) SetFn {
+	return httpRedirect(addr, false)
+}
+
+// WithHTTPRedirectBehindProxy is like WithHTTPRedirect, but when the requests contain the X-Forwarded-Host header
+// set by a reverse proxy, the redirect uses that host.
+func WithHTTPRedirectBehindProxy(addr string) SetFn {
+	return httpRedirect(addr, true)
+}
+
+func httpRedirect(addr string, forwarded bool) SetFn {
+	return func(c *c) error {
+		if addr == "" {
+			addr = ":http"
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		c.aux = append(c.aux, auxServer{l: l, h: redirectHandler(forwarded)})
+		return nil
+	}
+}
+
+// OnAdmin serves h on the TCP address addr, separately from the server's handler, which makes it suitable
+// for exposing health checks or metrics on a private address. It's started and stopped together with the server,
+// but it doesn't use the handler wrappers, like WithAccessLog or WithRecover, nor the listener wrappers,
+// like WithMaxConns or WithProxyProtocol.
+func OnAdmin(addr string, h http.Handler) SetFn {
+	return func(c *c) error {
+		if h == nil {
+			return fmt.Errorf("nil admin handler")
+		}
+		l, err := listenTCP(net.ListenConfig{}, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		c.aux = append(c.aux, auxServer{l: l, h: h})
+		return nil
+	}
+}
+
+// redirectHandler redirects to the https version of the request's URL, on the default port
+func redirectHandler(forwarded bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if fh := r.Header.Get("X-Forwarded-Host"); forwarded && fh != "" {
+			host = fh
+		}
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	})
+}
+
+// WithReadyChan sets a channel that gets closed once the server has started serving on all its listeners,
+// as the function starting the server blocks until it stops.
+func WithReadyChan(ch chan<- struct{}) SetFn {
+	return func(c *c) error {
+		c.readyCh = ch
+		return nil
+	}
+}
+
+func Handler(h http.Handler) SetFn {
+	return func(c *c) error {
+		c.s.Handler = h
+		return nil
 	}
 }
 
@@ -94,59 +870,701 @@ var (
 	defaultRunFn = func() error {
 		return nil
 	}
+	errRunFn = func(err error) func() error {
+		return func() error {
+			return err
+		}
+	}
 )
 
-// HttpServer initializes a http.Server object with values set using SetFn() functions
+func hasCertificates(cfg *tls.Config) bool {
+	return cfg != nil && (len(cfg.Certificates) > 0 || cfg.GetCertificate != nil)
+}
+
+// useTLS returns true if certificate files, or in memory certificates have been configured
+func (c *c) useTLS() bool {
+	return len(c.cert) > 0 && len(c.key) > 0 || hasCertificates(c.s.TLSConfig)
+}
+
+// checkTLS reports the certificates configured without a listener to use them, and the other way around
+func (c *c) checkTLS() error {
+	if len(c.tls) > 0 && !c.useTLS() {
+		return fmt.Errorf("TLS listeners have been configured without a certificate")
+	}
+	if len(c.tls) == 0 && len(c.services) == 0 && c.useTLS() {
+		return fmt.Errorf("a certificate has been configured, but no listener serves TLS, see WithTLS")
+	}
+	return nil
+}
+
+// loadCertFiles adds the certificate passed to HTTPS in front of the in memory ones, as ServeTLS ignores
+// the files when the TLS configuration already contains certificates
+func (c *c) loadCertFiles() error {
+	cfg := c.s.TLSConfig
+	if c.cert == "" || c.key == "" || len(cfg.Certificates) == 0 || cfg.GetCertificate != nil {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.cert, c.key)
+	if err != nil {
+		return fmt.Errorf("unable to load certificate %q: %w", c.cert, err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("invalid certificate %q: %w", c.cert, err)
+	}
+	cfg.Certificates = append([]tls.Certificate{cert}, cfg.Certificates...)
+	return nil
+}
+
+// tlsConfig returns a copy of the server's TLS configuration, with the certificate passed to HTTPS loaded,
+// for serving TLS without ServeTLS
+func (c *c) tlsConfig() (*tls.Config, error) {
+	cfg := c.s.TLSConfig.Clone()
+	if !hasCertificates(cfg) && c.cert != "" && c.key != "" {
+		cert, err := tls.LoadX509KeyPair(c.cert, c.key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load certificate %q: %w", c.cert, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// certFiles returns the certificate and key files to be loaded by ServeTLS, which are empty
+// when the TLS configuration already contains certificates
+func (c *c) certFiles() (string, string) {
+	if hasCertificates(c.s.TLSConfig) {
+		return "", ""
+	}
+	return c.cert, c.key
+}
+
+// HttpServer initializes a http.Server object with values set using SetFn() functions.
+// It returns a function that starts serving and blocks until the server is stopped, and a function
+// that stops it, draining the connections in progress.
 func HttpServer(ctx context.Context, setters ...SetFn) (func() error, func() error) {
-	c := new(c)
-	var serveFn, stopFn func() error
+	c, err := newServer(ctx, setters...)
+	if err != nil {
+		return errRunFn(err), defaultRunFn
+	}
+	start := func() error {
+		return c.start()
+	}
+	stop := func() error {
+		return c.stop(ctx)
+	}
+	return start, stop
+}
+
+// newServer creates the server configured by setters, the requests' contexts derive from ctx
+func newServer(ctx context.Context, setters ...SetFn) (*c, error) {
+	c := &c{
+		s:    &http.Server{TLSConfig: defaultTLSConfig.Clone()},
+		done: make(chan struct{}),
+		logf: nopLogFn,
+	}
 	for _, fn := range setters {
 		if err := fn(c); err != nil {
-			serveFn = func() error { return err }
+			// we don't want to leak the listeners created by the previous setters
+			c.closeListeners()
+			return nil, err
 		}
-		stopFn = defaultRunFn
 	}
-	if c.l == nil {
-		serveFn = func() error { return fmt.Errorf("no listeners have been configured") }
+	if len(c.l) == 0 && len(c.services) == 0 && len(c.udp) == 0 {
+		return nil, fmt.Errorf("no listeners have been configured")
 	}
+	if err := c.checkTLS(); err != nil {
+		c.closeListeners()
+		return nil, err
+	}
+	if err := c.setListenBacklog(); err != nil {
+		c.closeListeners()
+		return nil, err
+	}
+	if c.s.Handler == nil && (len(c.wrap) > 0 || c.trusted != nil || c.h2c) {
+		c.s.Handler = http.DefaultServeMux
+	}
+	for _, wrap := range c.wrap {
+		c.s.Handler = wrap(c.s.Handler)
+	}
+	if c.trusted != nil {
+		c.s.Handler = c.trusted(c.s.Handler)
+	}
+	if c.noHTTP2 {
+		// it's done after the setters, as they can replace the TLS configuration
+		c.s.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		protos := make([]string, 0, len(c.s.TLSConfig.NextProtos))
+		for _, p := range c.s.TLSConfig.NextProtos {
+			if p != http2.NextProtoTLS {
+				protos = append(protos, p)
+			}
+		}
+		c.s.TLSConfig.NextProtos = protos
+	}
+	if err := c.configureALPN(); err != nil {
+		c.closeListeners()
+		return nil, err
+	}
+	if c.h2c {
+		// the h2c handler needs to be the outermost, as it takes over the connection
+		c.s.Handler = h2c.NewHandler(c.s.Handler, &http2.Server{})
+	}
+	// the base context needs to be set before any listener starts serving
+	c.base = newGraceContext(ctx)
+	c.udpCtx, c.udpCancel = context.WithCancel(c.base)
+	c.s.BaseContext = func(l net.Listener) context.Context {
+		if c.baseFn == nil {
+			return c.base
+		}
+		return valuesContext{Context: c.base, values: c.baseFn(l)}
+	}
+	for _, fn := range c.serverFns {
+		fn(c.s)
+	}
+	if _, ok := c.s.TLSNextProto["h2"]; len(c.tls) > 0 && (c.s.TLSNextProto == nil || ok) && !hasProto(c.s.TLSConfig.NextProtos, "h2") {
+		// Serve and ServeTLS race to set up HTTP/2, and Serve skips it when the TLS configuration doesn't offer it,
+		// leaving the TLS listeners negotiating HTTP/2 without a server for it
+		c.s.TLSConfig.NextProtos = append(c.s.TLSConfig.NextProtos, "h2")
+	}
+	if err := c.loadCertFiles(); err != nil {
+		c.closeListeners()
+		return nil, err
+	}
+	if err := c.initOCSP(); err != nil {
+		c.closeListeners()
+		return nil, err
+	}
+	if err := c.initServices(); err != nil {
+		c.closeListeners()
+		return nil, err
+	}
+	if err := c.initTickets(); err != nil {
+		c.closeListeners()
+		return nil, err
+	}
+	c.s.ConnState = c.conns.track(c.s.ConnState)
+	// the listeners are saved before getting wrapped, as Restart needs their file descriptors
+	c.raw = append([]net.Listener{}, c.l...)
+	for _, wrap := range c.wrapListener {
+		for i := range c.l {
+			c.l[i] = wrap(c.l[i])
+		}
+	}
+	for i := range c.aux {
+		c.aux[i].s = c.auxServer(c.aux[i].h)
+	}
+	if c.readyFn != nil {
+		addrs := make([]net.Addr, 0, len(c.l)+len(c.aux))
+		for _, l := range c.l {
+			addrs = append(addrs, l.Addr())
+		}
+		for _, a := range c.aux {
+			addrs = append(addrs, a.l.Addr())
+		}
+		for _, s := range c.services {
+			addrs = append(addrs, s.Addr())
+		}
+		for _, u := range c.udp {
+			addrs = append(addrs, u.pc.LocalAddr())
+		}
+		c.readyFn(addrs)
+	}
+	return c, nil
+}
+
+// Server is a HTTP server that runs until its context gets canceled
+type Server struct {
+	c *c
+}
 
-	srv := &http.Server{
-		Handler:      c.h,
-		Addr:         c.addr,
-		WriteTimeout: c.wTimeOut,
+// NewServer creates a Server configured with setters
+func NewServer(setters ...SetFn) (*Server, error) {
+	// the requests' contexts don't derive from the one passed to Run, so they don't get canceled when the shutdown starts
+	c, err := newServer(context.Background(), setters...)
+	if err != nil {
+		return nil, err
 	}
-	switch c.l.(type) {
-	case *net.UnixListener:
-		serveFn = func() error {
-			return srv.Serve(c.l)
+	return &Server{c: c}, nil
+}
+
+// Run serves on the configured listeners until ctx gets canceled, when it shuts down the server gracefully,
+// waiting for the requests in progress at most the duration set by GracefulWait.
+// It returns the errors encountered when serving and when shutting down.
+func (s *Server) Run(ctx context.Context) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.c.start()
+	}()
+
+	var err error
+	served := false
+	select {
+	case err = <-errCh:
+		served = true
+	case <-ctx.Done():
+	}
+	// the shutdown needs a context of its own, as ctx is most likely canceled
+	if stopErr := s.c.stop(context.Background()); stopErr != nil {
+		err = errors.Join(err, stopErr)
+	}
+	if !served {
+		if serveErr := <-errCh; serveErr != nil {
+			err = errors.Join(err, serveErr)
 		}
-	case *net.TCPListener:
-		if len(c.cert) > 0 && len(c.key) > 0{
-			serveFn = func() error {
-				return srv.ServeTLS(c.l, c.cert, c.key)
-			}
-		} else {
-			serveFn = func() error {
-				return srv.Serve(c.l)
+	}
+	return err
+}
+
+// ForceStop stops the server right away, closing all the connections, including the ones with requests in progress.
+// Run returns after it's called.
+func (s *Server) ForceStop() error {
+	return s.c.forceStop()
+}
+
+// start serves on all the listeners and blocks until all of them are stopped
+func (c *c) start() error {
+	count := len(c.l) + len(c.aux) + len(c.services) + len(c.udp)
+	// every serve goroutine sends exactly one error, so with room for all of them
+	// none gets blocked, even if we stop receiving early
+	errChan := make(chan error, count)
+	for i, l := range c.l {
+		c.logf("listening on %s", l.Addr())
+		go func(l net.Listener, useTLS bool) {
+			errChan <- c.serve(l, useTLS)
+		}(l, c.tls[i])
+	}
+	for _, a := range c.aux {
+		c.logf("listening on %s", a.l.Addr())
+		go func(a auxServer) {
+			errChan <- serveErr(a.l, a.s.Serve(a.l))
+		}(a)
+	}
+	for _, s := range c.services {
+		c.logf("listening on %s/%s", s.Addr(), s.Addr().Network())
+		go func(s Service) {
+			errChan <- c.serveService(s)
+		}(s)
+	}
+	for _, u := range c.udp {
+		c.logf("listening on %s/%s", u.pc.LocalAddr(), u.pc.LocalAddr().Network())
+		go func(u udpService) {
+			errChan <- c.serveUDP(u)
+		}(u)
+	}
+	if c.watchdog > 0 {
+		c.background(func(done <-chan struct{}) {
+			pingWatchdog(c.watchdog, done)
+		})
+	}
+	if c.ocsp != nil && c.ocspRefresh > 0 {
+		c.background(func(done <-chan struct{}) {
+			c.ocsp.refresh(c.ocspRefresh, c.logf, done)
+		})
+	}
+	if c.tickets != nil {
+		c.background(func(done <-chan struct{}) {
+			c.tickets.run(c.ticketRotation, c.logf, done)
+		})
+	}
+	c.ready()
+	var err, stopErr error
+	for i := 0; i < count; i++ {
+		if e := <-errChan; e != nil && !errors.Is(e, http.ErrServerClosed) {
+			if err == nil {
+				// we don't keep serving on part of the listeners, so the failure doesn't go unnoticed,
+				// but the requests in progress on the other ones get to finish
+				c.logf("stopping the other listeners: %s", e)
+				stopErr = c.stop(context.Background())
 			}
+			err = errors.Join(err, e)
+		}
+	}
+	return errors.Join(err, stopErr)
+}
+
+// closeServers stops serving on all the listeners, without waiting for the connections in progress
+func (c *c) closeServers() error {
+	var err error
+	for _, a := range c.aux {
+		if e := a.s.Close(); e != nil {
+			err = errors.Join(err, e)
 		}
 	}
-	stopFn = func() error {
-		return c.l.Close()
+	if e := c.s.Close(); e != nil {
+		err = errors.Join(err, e)
+	}
+	if e := c.closeServices(); e != nil {
+		err = errors.Join(err, e)
 	}
+	if e := c.closeUDP(); e != nil {
+		err = errors.Join(err, e)
+	}
+	return err
+}
 
-	stop := func() error {
-		if err := srv.Shutdown(ctx); err != nil {
-			return err
+// ready signals that the server is serving
+func (c *c) ready() {
+	if c.readyCh != nil {
+		close(c.readyCh)
+	}
+	if c.notify {
+		// failing to notify systemd is not fatal for the server, it will handle a unit that doesn't become ready
+		_ = SystemdNotify("READY=1")
+	}
+}
+
+// background runs fn in a goroutine which is expected to return when the done channel it receives gets closed.
+// Nothing is run if the server has already stopped.
+func (c *c) background(fn func(done <-chan struct{})) {
+	c.bgM.Lock()
+	defer c.bgM.Unlock()
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	c.bg.Add(1)
+	go func() {
+		defer c.bg.Done()
+		fn(c.done)
+	}()
+}
+
+// stopBackground signals the background goroutines to end and waits for them
+func (c *c) stopBackground() {
+	c.bgM.Lock()
+	c.doneOnce.Do(func() {
+		close(c.done)
+	})
+	c.bgM.Unlock()
+	c.bg.Wait()
+}
+
+func (c *c) serve(l net.Listener, useTLS bool) error {
+	if useTLS {
+		cert, key := c.certFiles()
+		return serveErr(l, c.s.ServeTLS(l, cert, key))
+	}
+	return serveErr(l, c.s.Serve(l))
+}
+
+func serveErr(l net.Listener, err error) error {
+	if err == nil {
+		return nil
+	}
+	return ListenerError{Addr: l.Addr(), Err: err}
+}
+
+// ListenerError is returned when serving on one of the listeners fails,
+// callers can find out which one it was with errors.As.
+type ListenerError struct {
+	Addr net.Addr
+	Err  error
+}
+
+func (e ListenerError) Error() string {
+	return fmt.Sprintf("error on listener %s: %s", e.Addr, e.Err)
+}
+
+func (e ListenerError) Unwrap() error {
+	return e.Err
+}
+
+// auxServer creates a server for h, with the same settings as the main one
+func (c *c) auxServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           h,
+		ReadTimeout:       c.s.ReadTimeout,
+		ReadHeaderTimeout: c.s.ReadHeaderTimeout,
+		WriteTimeout:      c.s.WriteTimeout,
+		IdleTimeout:       c.s.IdleTimeout,
+		MaxHeaderBytes:    c.s.MaxHeaderBytes,
+		ErrorLog:          c.s.ErrorLog,
+		BaseContext:       c.s.BaseContext,
+		ConnContext:       c.s.ConnContext,
+		ConnState:         c.s.ConnState,
+	}
+}
+
+// graceContext is the base context of the requests, which gets the deadline of the graceful shutdown
+// when the server starts stopping.
+type graceContext struct {
+	context.Context
+	cancelFn context.CancelFunc
+
+	m        sync.Mutex
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func newGraceContext(parent context.Context) *graceContext {
+	ctx, cancelFn := context.WithCancel(parent)
+	return &graceContext{Context: ctx, cancelFn: cancelFn}
+}
+
+func (g *graceContext) Deadline() (time.Time, bool) {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	if d, ok := g.Context.Deadline(); ok && (g.deadline.IsZero() || d.Before(g.deadline)) {
+		return d, true
+	}
+	return g.deadline, !g.deadline.IsZero()
+}
+
+// setDeadline makes the context get canceled at d
+func (g *graceContext) setDeadline(d time.Time) {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+	g.deadline = d
+	g.timer = time.AfterFunc(time.Until(d), g.cancelFn)
+}
+
+func (g *graceContext) cancel() {
+	g.m.Lock()
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+	g.m.Unlock()
+	g.cancelFn()
+}
+
+// valuesContext is a context with the cancellation and deadline of the embedded context,
+// and the values of both of them, with the ones in values taking precedence
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (v valuesContext) Value(key interface{}) interface{} {
+	if val := v.values.Value(key); val != nil {
+		return val
+	}
+	return v.Context.Value(key)
+}
+
+// ShutdownError is returned by the stop function when the server didn't shut down gracefully,
+// usually because the context expired while there were still requests in progress.
+type ShutdownError struct {
+	// Active is the number of connections which had requests in progress
+	Active int
+	Err    error
+}
+
+func (e ShutdownError) Error() string {
+	return fmt.Sprintf("shutdown with %d active connections: %s", e.Active, e.Err)
+}
+
+func (e ShutdownError) Unwrap() error {
+	return e.Err
+}
+
+// connTracker keeps the state of the open connections of the servers
+type connTracker struct {
+	m     sync.Mutex
+	conns map[net.Conn]http.ConnState
+}
+
+// track returns a http.Server.ConnState function that records the connections' state before calling next
+func (t *connTracker) track(next func(net.Conn, http.ConnState)) func(net.Conn, http.ConnState) {
+	return func(conn net.Conn, state http.ConnState) {
+		t.m.Lock()
+		if t.conns == nil {
+			t.conns = make(map[net.Conn]http.ConnState)
 		}
-		if err := stopFn(); err != nil {
-			return err
+		switch state {
+		case http.StateClosed, http.StateHijacked:
+			delete(t.conns, conn)
+		default:
+			t.conns[conn] = state
 		}
+		t.m.Unlock()
+		if next != nil {
+			next(conn, state)
+		}
+	}
+}
+
+// active returns the number of connections with requests in progress
+func (t *connTracker) active() int {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	n := 0
+	for _, state := range t.conns {
+		if state == http.StateActive {
+			n++
+		}
+	}
+	return n
+}
+
+// stop shuts down the servers gracefully: the listeners are closed first, so new connections are refused right away,
+// then the requests in progress are allowed to finish until ctx expires, or the GracefulWait duration passes.
+// Only the first call shuts down the servers and returns the errors, the others wait for it to finish.
+func (c *c) stop(ctx context.Context) error {
+	var err error
+	c.stopOnce.Do(func() {
+		err = c.shutdown(ctx)
+	})
+	return err
+}
+
+func (c *c) shutdown(ctx context.Context) (err error) {
+	c.logf("shutting down")
+	c.stopping.Store(true)
+	defer func() {
+		if err != nil {
+			c.logf("shutdown failed: %s", err)
+			return
+		}
+		c.logf("shutdown complete")
+	}()
+	// the callbacks get the context before the GracefulWait timeout gets applied, as that might have expired
+	defer func(ctx context.Context) {
+		for _, fn := range c.onShutdown {
+			if e := fn(ctx); e != nil {
+				err = errors.Join(err, e)
+			}
+		}
+	}(ctx)
+	if c.drainDelay > 0 {
+		// the server is not ready anymore, but keeps serving until the load balancers find out
+		c.logf("waiting %s before draining", c.drainDelay)
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+		case <-time.After(c.drainDelay):
 		}
 	}
-	// Run our server in a goroutine so that it doesn't block.
-	return serveFn, stop
+	// the requests get GracefulWait to finish, and the shutdown timeout starts after it
+	now := time.Now()
+	if c.gWait > 0 || c.shutdownTimeout > 0 {
+		var cancelFn context.CancelFunc
+		ctx, cancelFn = context.WithDeadline(ctx, now.Add(c.gWait+c.shutdownTimeout))
+		defer cancelFn()
+	}
+	if c.notify {
+		_ = SystemdNotify("STOPPING=1")
+	}
+	defer c.stopBackground()
+	// the requests still running after the graceful shutdown get their context canceled
+	defer c.base.cancel()
+	deadline, ok := ctx.Deadline()
+	// with a shutdown timeout, the requests get it in full after their contexts get canceled
+	if graceful := now.Add(c.gWait); (c.gWait > 0 || c.shutdownTimeout > 0) && graceful.Before(deadline) {
+		deadline = graceful
+	}
+	if ok {
+		// the requests in progress can find out how much time they have left to finish
+		c.base.setDeadline(deadline)
+	}
+	// the services don't support graceful shutdown, they get closed even if draining the HTTP connections fails
+	defer func() {
+		if e := c.closeServices(); e != nil {
+			err = errors.Join(err, e)
+		}
+	}()
+	// there's nothing to drain for the UDP handlers
+	if e := c.closeUDP(); e != nil {
+		err = errors.Join(err, e)
+	}
+	// all the servers get shut down, even if one of them fails
+	var shutdownErr error
+	for _, a := range c.aux {
+		if e := a.s.Shutdown(ctx); e != nil {
+			shutdownErr = errors.Join(shutdownErr, e)
+		}
+	}
+	if e := c.s.Shutdown(ctx); e != nil {
+		shutdownErr = errors.Join(shutdownErr, e)
+	}
+	if shutdownErr != nil {
+		err = errors.Join(err, c.shutdownError(shutdownErr))
+	}
+	// the listeners that have been served are already closed by Shutdown
+	if e := c.closeListeners(); e != nil {
+		err = errors.Join(err, e)
+	}
+	return err
+}
+
+// shutdownError returns the ShutdownError for err, after closing the active connections if WithShutdownTimeout is used
+func (c *c) shutdownError(err error) error {
+	serr := ShutdownError{Active: c.conns.active(), Err: err}
+	if c.shutdownTimeout > 0 {
+		if e := c.closeServers(); e != nil {
+			return errors.Join(serr, e)
+		}
+	}
+	return serr
+}
+
+// forceStop closes the servers, without waiting for the requests in progress
+func (c *c) forceStop() error {
+	c.logf("stopping")
+	c.stopping.Store(true)
+	if c.notify {
+		_ = SystemdNotify("STOPPING=1")
+	}
+	defer c.stopBackground()
+	defer c.base.cancel()
+
+	err := c.closeServers()
+	if e := c.closeListeners(); e != nil {
+		err = errors.Join(err, e)
+	}
+	return err
+}
+
+// closeListeners closes all the listeners, ignoring the ones that are already closed
+func (c *c) closeListeners() error {
+	listeners := append([]net.Listener{}, c.l...)
+	for _, a := range c.aux {
+		listeners = append(listeners, a.l)
+	}
+	var err error
+	for _, l := range listeners {
+		if e := l.Close(); e != nil && !errors.Is(e, net.ErrClosed) {
+			err = errors.Join(err, e)
+		}
+	}
+	if e := c.closeServices(); e != nil {
+		err = errors.Join(err, e)
+	}
+	if e := c.closeUDP(); e != nil {
+		err = errors.Join(err, e)
+	}
+	return err
+}
+
+// ServeHTTP runs a server configured with setters until it receives SIGINT or SIGTERM, or ctx gets canceled,
+// when it gets stopped gracefully, waiting for the requests in progress to finish.
+// The handlers for other signals can be passed in handlers, which can also override the ones for SIGINT and SIGTERM.
+// Like for NewServer, the requests' contexts don't derive from ctx, so they don't get canceled when the shutdown starts.
+func ServeHTTP(ctx context.Context, handlers SignalHandlers, setters ...SetFn) error {
+	s, err := NewServer(setters...)
+	if err != nil {
+		return err
+	}
+
+	h := DefaultSignalHandlers()
+	for sig, fn := range handlers {
+		h[sig] = fn
+	}
+	done := make(chan struct{})
+	var runErr error
+	err = RegisterSignalHandlers(h).ExecContext(ctx, func(ctx context.Context) error {
+		defer close(done)
+		runErr = s.Run(ctx)
+		return runErr
+	})
+	// ExecContext returns as soon as the execution ends, while Run is still draining the requests in progress
+	<-done
+	if runErr != nil && !errors.Is(err, runErr) {
+		err = errors.Join(err, runErr)
+	}
+	return err
 }
@@ -0,0 +1,104 @@
+package wrapper
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestAbstractSocket(t *testing.T) {
+	name := fmt.Sprintf("@wrapper-test-%d", os.Getpid())
+	ts := startServer(t, OnSocketMode(name, 0600), Handler(hello))
+
+	if addr := ts.addrs[0].(*net.UnixAddr); addr.Name != name {
+		t.Errorf("the ready callback received %q, expected %q", addr.Name, name)
+	}
+	if body := get(t, unixClient(name), "http://unix/"); body != "hello" {
+		t.Errorf("received %q, expected %q", body, "hello")
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("a file has been created for the abstract socket: %v", err)
+	}
+	if err := ts.stop(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+}
+
+func TestOnTCPWithConfig(t *testing.T) {
+	lc := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var err error
+			cerr := c.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	first := configure(t, OnTCPWithConfig("127.0.0.1:0", lc))
+	addr := first.l[1].Addr().String()
+	second := configure(t, OnTCPWithConfig(addr, lc))
+	if got := second.l[1].Addr().String(); got != addr {
+		t.Errorf("the second server listens on %s, expected %s", got, addr)
+	}
+}
+
+// sockopt returns the value of the socket option opt of conn
+func sockopt(t *testing.T, conn net.Conn, level, opt int) int {
+	t.Helper()
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("unable to get the raw connection: %s", err)
+	}
+	var v int
+	cerr := rc.Control(func(fd uintptr) {
+		v, err = unix.GetsockoptInt(int(fd), level, opt)
+	})
+	if cerr != nil || err != nil {
+		t.Fatalf("unable to get the socket option %d: %v %v", opt, cerr, err)
+	}
+	return v
+}
+
+func TestWithTCPKeepAlive(t *testing.T) {
+	tests := map[string]struct {
+		period    time.Duration
+		keepAlive int
+	}{
+		"enabled":  {period: 42 * time.Second, keepAlive: 1},
+		"disabled": {period: 0, keepAlive: 0},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			// the listener is accepted from directly, instead of the server, so we can get the connection
+			l := configure(t, WithTCPKeepAlive(tt.period)).l[0]
+			client, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatalf("unable to connect: %s", err)
+			}
+			defer client.Close()
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatalf("unable to accept the connection: %s", err)
+			}
+			defer conn.Close()
+
+			if v := sockopt(t, conn, unix.SOL_SOCKET, unix.SO_KEEPALIVE); v != tt.keepAlive {
+				t.Errorf("SO_KEEPALIVE is %d, expected %d", v, tt.keepAlive)
+			}
+			if tt.keepAlive == 0 {
+				return
+			}
+			if v := sockopt(t, conn, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE); v != int(tt.period.Seconds()) {
+				t.Errorf("TCP_KEEPIDLE is %d, expected %d", v, int(tt.period.Seconds()))
+			}
+		})
+	}
+}
@@ -0,0 +1,1343 @@
+package wrapper
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+)
+
+// testServer is a server started by startServer, running until stop is called, or the test ends
+type testServer struct {
+	*Server
+	addrs    []net.Addr
+	cancelFn context.CancelFunc
+	// done gets closed when Run returns err
+	done chan struct{}
+	err  error
+}
+
+// startServer runs the server configured by setters, reporting the addresses it listens on
+func startServer(t *testing.T, setters ...SetFn) *testServer {
+	t.Helper()
+	ts := &testServer{}
+	setters = append(setters, WithReadyCallback(func(addrs []net.Addr) {
+		ts.addrs = addrs
+	}))
+	s, err := NewServer(setters...)
+	if err != nil {
+		t.Fatalf("unable to create the server: %s", err)
+	}
+	ts.Server = s
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	ts.cancelFn = cancelFn
+	ts.done = make(chan struct{})
+	go func() {
+		defer close(ts.done)
+		ts.err = s.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancelFn()
+		<-ts.done
+	})
+	return ts
+}
+
+// url returns the URL of the i-th listener of the server
+func (ts *testServer) url(scheme string, i int) string {
+	return scheme + "://" + ts.addrs[i].String()
+}
+
+// stop cancels the context of the server, and returns the error Run returned
+func (ts *testServer) stop(t *testing.T) error {
+	t.Helper()
+	ts.cancelFn()
+	return ts.wait(t)
+}
+
+// wait returns the error Run returned, failing the test if it doesn't return in time
+func (ts *testServer) wait(t *testing.T) error {
+	t.Helper()
+	select {
+	case <-ts.done:
+		return ts.err
+	case <-time.After(testTimeout):
+		t.Fatalf("Run didn't return in %s", testTimeout)
+		return nil
+	}
+}
+
+// get requests url with client, failing the test if it doesn't succeed, and returns the body of the response
+func get(t *testing.T, client *http.Client, url string) string {
+	t.Helper()
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s failed: %s", url, err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("unable to read the response of %s: %s", url, err)
+	}
+	return string(body)
+}
+
+// hello is a handler responding with "hello"
+var hello = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "hello")
+})
+
+func TestReadyCallback(t *testing.T) {
+	ts := startServer(t, HTTP("127.0.0.1:0"), Handler(hello))
+	if len(ts.addrs) != 1 {
+		t.Fatalf("the ready callback received %v, expected one address", ts.addrs)
+	}
+	if port := ts.addrs[0].(*net.TCPAddr).Port; port == 0 {
+		t.Errorf("the reported port is 0")
+	}
+	if body := get(t, http.DefaultClient, ts.url("http", 0)); body != "hello" {
+		t.Errorf("received %q, expected %q", body, "hello")
+	}
+	if err := ts.stop(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+}
+
+// configure creates the server configured by setters, listening on an ephemeral port, without starting it
+func configure(t *testing.T, setters ...SetFn) *c {
+	t.Helper()
+	c, err := newServer(context.Background(), append([]SetFn{HTTP("127.0.0.1:0")}, setters...)...)
+	if err != nil {
+		t.Fatalf("unable to create the server: %s", err)
+	}
+	t.Cleanup(func() {
+		c.forceStop()
+	})
+	return c
+}
+
+func TestReadWait(t *testing.T) {
+	if d := configure(t, ReadWait(3*time.Second)).s.ReadTimeout; d != 3*time.Second {
+		t.Errorf("the server's ReadTimeout is %s, expected %s", d, 3*time.Second)
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	c := configure(t)
+	if c.s.ReadHeaderTimeout != 0 || c.s.IdleTimeout != 0 {
+		t.Errorf("the server's timeouts are %s and %s, expected them unset", c.s.ReadHeaderTimeout, c.s.IdleTimeout)
+	}
+	c = configure(t, ReadHeaderWait(time.Second), IdleWait(2*time.Second))
+	if c.s.ReadHeaderTimeout != time.Second {
+		t.Errorf("the server's ReadHeaderTimeout is %s, expected %s", c.s.ReadHeaderTimeout, time.Second)
+	}
+	if c.s.IdleTimeout != 2*time.Second {
+		t.Errorf("the server's IdleTimeout is %s, expected %s", c.s.IdleTimeout, 2*time.Second)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	if n := configure(t, MaxHeaderBytes(4096)).s.MaxHeaderBytes; n != 4096 {
+		t.Errorf("the server's MaxHeaderBytes is %d, expected 4096", n)
+	}
+	if n := configure(t, MaxHeaderBytes(0)).s.MaxHeaderBytes; n != 0 {
+		t.Errorf("the server's MaxHeaderBytes is %d, expected the default", n)
+	}
+	if _, err := NewServer(HTTP("127.0.0.1:0"), MaxHeaderBytes(-1)); err == nil {
+		t.Errorf("NewServer succeeded with a negative MaxHeaderBytes")
+	}
+}
+
+func TestWithTLSConfig(t *testing.T) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS13}
+	for i := 0; i < 2; i++ {
+		ts := startServer(t, WithTLS(HTTP("127.0.0.1:0")), WithTLSConfig(cfg), WithSelfSignedCert(), Handler(hello))
+		if v := ts.c.s.TLSConfig.MinVersion; v != tls.VersionTLS13 {
+			t.Errorf("the server's TLS MinVersion is %x, expected %x", v, tls.VersionTLS13)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		if body := get(t, client, ts.url("https", 0)); body != "hello" {
+			t.Errorf("received %q, expected %q", body, "hello")
+		}
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         tls.VersionTLS12,
+		}}}
+		if _, err := client.Get(ts.url("https", 0)); err == nil {
+			t.Errorf("a TLS 1.2 client has been able to connect")
+		}
+	}
+	if len(cfg.Certificates) > 0 {
+		t.Errorf("the configuration passed to WithTLSConfig has been modified")
+	}
+}
+
+// testCert generates a self signed certificate for 127.0.0.1, returning it with its PEM encoding
+func testCert(t *testing.T) (tls.Certificate, []byte, []byte) {
+	t.Helper()
+	cert, err := selfSignedCert([]string{"127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatalf("unable to generate the certificate: %s", err)
+	}
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("unable to encode the key: %s", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})
+	return cert, certPEM, keyPEM
+}
+
+// testCertFiles writes a self signed certificate for 127.0.0.1 and its key to files, returning their paths
+func testCertFiles(t *testing.T) (string, string) {
+	t.Helper()
+	_, certPEM, keyPEM := testCert(t)
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(cert, certPEM, 0600); err != nil {
+		t.Fatalf("unable to write the certificate: %s", err)
+	}
+	if err := os.WriteFile(key, keyPEM, 0600); err != nil {
+		t.Fatalf("unable to write the key: %s", err)
+	}
+	return cert, key
+}
+
+// tlsClient returns a client trusting the certificates in certPEM, or any certificate if certPEM is nil
+func tlsClient(certPEM []byte) *http.Client {
+	cfg := &tls.Config{InsecureSkipVerify: true}
+	if certPEM != nil {
+		cfg = &tls.Config{RootCAs: x509.NewCertPool()}
+		cfg.RootCAs.AppendCertsFromPEM(certPEM)
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+}
+
+func TestInMemoryCertificates(t *testing.T) {
+	cert, certPEM, keyPEM := testCert(t)
+	setters := map[string]SetFn{
+		"WithCertificate": WithCertificate(cert),
+		"WithCertPEM":     WithCertPEM(certPEM, keyPEM),
+	}
+	for name, fn := range setters {
+		t.Run(name, func(t *testing.T) {
+			ts := startServer(t, WithTLS(HTTP("127.0.0.1:0")), fn, Handler(hello))
+			if body := get(t, tlsClient(certPEM), ts.url("https", 0)); body != "hello" {
+				t.Errorf("received %q, expected %q", body, "hello")
+			}
+		})
+	}
+	t.Run("invalid PEM", func(t *testing.T) {
+		if _, err := NewServer(WithTLS(HTTP("127.0.0.1:0")), WithCertPEM(certPEM, []byte("invalid"))); err == nil {
+			t.Errorf("NewServer succeeded with an invalid PEM key")
+		}
+	})
+}
+
+func TestWithAutocert(t *testing.T) {
+	cacheDir := filepath.Join(t.TempDir(), "certs")
+	ts := startServer(t, HTTP("127.0.0.1:0"), WithTLS(HTTP("127.0.0.1:0")),
+		WithAutocert(autocert.HostWhitelist("example.com"), cacheDir), Handler(hello))
+
+	if fi, err := os.Stat(cacheDir); err != nil || !fi.IsDir() {
+		t.Errorf("the cache directory has not been created: %v", err)
+	}
+	cfg := ts.c.s.TLSConfig
+	if cfg.GetCertificate == nil {
+		t.Errorf("the GetCertificate hook has not been installed")
+	}
+	if !hasProto(cfg.NextProtos, acme.ALPNProto) {
+		t.Errorf("the TLS protocols %v don't include %s", cfg.NextProtos, acme.ALPNProto)
+	}
+
+	if body := get(t, http.DefaultClient, ts.url("http", 0)); body != "hello" {
+		t.Errorf("received %q, expected the response of the handler", body)
+	}
+	req, _ := http.NewRequest(http.MethodGet, ts.url("http", 0)+"/.well-known/acme-challenge/token", nil)
+	req.Host = "example.com"
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("the challenge request failed: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("the challenge for an unknown token returned %s, expected %d", res.Status, http.StatusNotFound)
+	}
+	// the host policy rejects the handshake, without contacting the ACME server
+	if _, err := tlsClient(nil).Get(ts.url("https", 1)); err == nil {
+		t.Errorf("the TLS handshake succeeded for a host that is not allowed")
+	}
+}
+
+func TestWithSelfSignedCert(t *testing.T) {
+	ts := startServer(t, WithTLS(HTTP("127.0.0.1:0")), WithSelfSignedCert(), Handler(hello))
+
+	res, err := tlsClient(nil).Get(ts.url("https", 0))
+	if err != nil {
+		t.Fatalf("the TLS request failed: %s", err)
+	}
+	res.Body.Close()
+	leaf := res.TLS.PeerCertificates[0]
+	if err = leaf.VerifyHostname("localhost"); err != nil {
+		t.Errorf("the certificate is not valid for localhost: %s", err)
+	}
+	if err = leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Errorf("the certificate is not valid for 127.0.0.1: %s", err)
+	}
+	if validity := time.Until(leaf.NotAfter); validity > 24*time.Hour {
+		t.Errorf("the certificate is valid for %s, expected at most a day", validity)
+	}
+}
+
+// clientCert generates a self signed client certificate, returning it with its PEM encoding
+func clientCert(t *testing.T) (tls.Certificate, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate the key: %s", err)
+	}
+	tpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tpl, &tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create the certificate: %s", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, certPEM
+}
+
+func TestClientCertificates(t *testing.T) {
+	cert, certPEM := clientCert(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, certPEM, 0600); err != nil {
+		t.Fatalf("unable to write the CA file: %s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+
+	peer := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	})
+	setters := map[string]SetFn{
+		"WithClientCAs":    WithClientCAs(pool),
+		"WithClientCAFile": WithClientCAFile(caFile),
+	}
+	for name, fn := range setters {
+		t.Run(name, func(t *testing.T) {
+			ts := startServer(t, WithTLS(HTTP("127.0.0.1:0")), WithSelfSignedCert(), fn,
+				WithClientAuth(tls.RequireAndVerifyClientCert), WithErrorLog(log.New(io.Discard, "", 0)), Handler(peer))
+
+			if _, err := tlsClient(nil).Get(ts.url("https", 0)); err == nil {
+				t.Errorf("a client without a certificate has been accepted")
+			}
+			client := tlsClient(nil)
+			client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{cert}
+			if body := get(t, client, ts.url("https", 0)); body != "client" {
+				t.Errorf("the handler received the client certificate for %q, expected %q", body, "client")
+			}
+		})
+	}
+}
+
+func TestWithListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	ts := startServer(t, WithListener(l), Handler(hello))
+	if body := get(t, http.DefaultClient, "http://"+l.Addr().String()); body != "hello" {
+		t.Errorf("received %q, expected %q", body, "hello")
+	}
+	if err = ts.stop(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+	if _, err = NewServer(WithListener(nil)); err == nil {
+		t.Errorf("NewServer succeeded with a nil listener")
+	}
+}
+
+func TestWithServerOptions(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	c := configure(t, WithServerOptions(func(s *http.Server) {
+		s.ErrorLog = logger
+		s.ReadTimeout = 2 * time.Second
+	}), ReadWait(time.Second))
+
+	if c.s.ErrorLog != logger {
+		t.Errorf("the server's ErrorLog has not been set")
+	}
+	if c.s.ReadTimeout != 2*time.Second {
+		t.Errorf("the server's ReadTimeout is %s, expected the %s set by WithServerOptions", c.s.ReadTimeout, 2*time.Second)
+	}
+}
+
+func TestWithErrorLog(t *testing.T) {
+	lines := make(chan string, 10)
+	logger := LogFnLogger(func(format string, args ...interface{}) {
+		lines <- fmt.Sprintf(format, args...)
+	})
+	ts := startServer(t, WithTLS(HTTP("127.0.0.1:0")), WithSelfSignedCert(), WithErrorLog(logger), Handler(hello))
+
+	// a plain HTTP request fails the TLS handshake
+	if res, err := http.Get(ts.url("http", 0)); err == nil {
+		res.Body.Close()
+	}
+	select {
+	case line := <-lines:
+		if !strings.Contains(line, "TLS handshake error") {
+			t.Errorf("logged %q, expected a TLS handshake error", line)
+		}
+		if strings.HasSuffix(line, "\n") {
+			t.Errorf("the logged line %q ends with a new line", line)
+		}
+	case <-time.After(testTimeout):
+		t.Errorf("nothing has been logged in %s", testTimeout)
+	}
+}
+
+func TestWithReadyChan(t *testing.T) {
+	ready := make(chan struct{})
+	ts := startServer(t, HTTP("127.0.0.1:0"), WithReadyChan(ready), Handler(hello))
+	select {
+	case <-ready:
+	case <-time.After(testTimeout):
+		t.Fatalf("the ready channel has not been closed in %s", testTimeout)
+	}
+	if body := get(t, http.DefaultClient, ts.url("http", 0)); body != "hello" {
+		t.Errorf("received %q, expected %q", body, "hello")
+	}
+
+	// the address is already in use
+	if _, err := NewServer(HTTP(ts.addrs[0].String()), WithReadyChan(make(chan struct{}))); err == nil {
+		t.Errorf("NewServer succeeded on an address that is in use")
+	}
+}
+
+// blocking returns a handler that signals on started when it receives a request, and waits for its context
+// to be canceled, reporting the context's error on canceled
+func blocking(started chan<- struct{}, canceled chan<- error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done()
+		canceled <- r.Context().Err()
+	})
+}
+
+func TestRequestContextCanceled(t *testing.T) {
+	started, canceled := make(chan struct{}, 1), make(chan error, 1)
+	ts := startServer(t, HTTP("127.0.0.1:0"), GracefulWait(50*time.Millisecond), Handler(blocking(started, canceled)))
+
+	go http.Get(ts.url("http", 0))
+	<-started
+	err := ts.stop(t)
+	if !errors.As(err, &ShutdownError{}) {
+		t.Errorf("Run returned %v, expected a ShutdownError", err)
+	}
+	select {
+	case err = <-canceled:
+		if err == nil {
+			t.Errorf("the request context has no error")
+		}
+	case <-time.After(testTimeout):
+		t.Errorf("the request context has not been canceled")
+	}
+}
+
+// noRedirects is a client that returns the redirect responses instead of following them
+var noRedirects = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}}
+
+func TestWithHTTPRedirect(t *testing.T) {
+	tests := []struct {
+		name      string
+		fn        func(string) SetFn
+		forwarded string
+		location  string
+	}{
+		{"direct", WithHTTPRedirect, "", "https://example.com/path?q=1"},
+		{"ignoring the forwarded host", WithHTTPRedirect, "proxied.com", "https://example.com/path?q=1"},
+		{"behind proxy", WithHTTPRedirectBehindProxy, "proxied.com", "https://proxied.com/path?q=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := startServer(t, WithTLS(HTTP("127.0.0.1:0")), WithSelfSignedCert(), tt.fn("127.0.0.1:0"), Handler(hello))
+
+			req, _ := http.NewRequest(http.MethodGet, ts.url("http", 1)+"/path?q=1", nil)
+			req.Host = "example.com:8080"
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-Host", tt.forwarded)
+			}
+			res, err := noRedirects.Do(req)
+			if err != nil {
+				t.Fatalf("the request failed: %s", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusMovedPermanently {
+				t.Errorf("received %s, expected %d", res.Status, http.StatusMovedPermanently)
+			}
+			if loc := res.Header.Get("Location"); loc != tt.location {
+				t.Errorf("redirected to %q, expected %q", loc, tt.location)
+			}
+			// the TLS listener keeps serving the handler
+			if body := get(t, tlsClient(nil), ts.url("https", 0)); body != "hello" {
+				t.Errorf("received %q, expected %q", body, "hello")
+			}
+		})
+	}
+}
+
+// proto is a handler responding with the protocol of the request
+var proto = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, r.Proto)
+})
+
+func TestWithH2C(t *testing.T) {
+	ts := startServer(t, HTTP("127.0.0.1:0"), WithTLS(HTTP("127.0.0.1:0")), WithSelfSignedCert(), WithH2C(), Handler(proto))
+
+	h2c := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	if body := get(t, h2c, ts.url("http", 0)); body != "HTTP/2.0" {
+		t.Errorf("the request has been served over %s, expected HTTP/2.0", body)
+	}
+	if body := get(t, http.DefaultClient, ts.url("http", 0)); body != "HTTP/1.1" {
+		t.Errorf("the request has been served over %s, expected HTTP/1.1", body)
+	}
+	// the TLS listener keeps negotiating HTTP/2
+	client := tlsClient(nil)
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+	if body := get(t, client, ts.url("https", 1)); body != "HTTP/2.0" {
+		t.Errorf("the TLS request has been served over %s, expected HTTP/2.0", body)
+	}
+}
+
+func TestWithMaxConns(t *testing.T) {
+	const n = 2
+	started, release := make(chan struct{}, n+2), make(chan struct{})
+	ts := startServer(t, HTTP("127.0.0.1:0"), WithMaxConns(n), GracefulWait(50*time.Millisecond),
+		Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-release
+		})))
+	defer close(release)
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for i := 0; i < n+2; i++ {
+		go func() {
+			if res, err := client.Get(ts.url("http", 0)); err == nil {
+				res.Body.Close()
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case <-started:
+		case <-time.After(testTimeout):
+			t.Fatalf("only %d requests have been served, expected %d", i, n)
+		}
+	}
+	select {
+	case <-started:
+		t.Errorf("more than %d connections are served at the same time", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// the connections waiting for the limit don't block the shutdown
+	if err := ts.stop(t); !errors.As(err, &ShutdownError{}) {
+		t.Errorf("Run returned %v, expected a ShutdownError", err)
+	}
+}
+
+// serveAsync runs ServeHTTP in a goroutine, returning the address of its first listener, once it has been bound,
+// and the channel ServeHTTP sends its result on
+func serveAsync(t *testing.T, ctx context.Context, setters ...SetFn) (string, <-chan error) {
+	t.Helper()
+	addrs := make(chan []net.Addr, 1)
+	setters = append(setters, WithReadyCallback(func(a []net.Addr) {
+		addrs <- a
+	}))
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeHTTP(ctx, nil, setters...)
+	}()
+	select {
+	case a := <-addrs:
+		return a[0].String(), done
+	case err := <-done:
+		t.Fatalf("ServeHTTP returned %v before listening", err)
+	case <-time.After(testTimeout):
+		t.Fatalf("the server has not been created in %s", testTimeout)
+	}
+	return "", nil
+}
+
+// draining returns a handler that signals on started when it receives a request, and responds after d,
+// reporting the error of the request's context at that time, then signals on finished
+func draining(started, finished chan<- struct{}, d time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		time.Sleep(d)
+		fmt.Fprint(w, r.Context().Err())
+		finished <- struct{}{}
+	})
+}
+
+// getAsync requests url in a goroutine, returning the channel the body of the response is sent on
+func getAsync(t *testing.T, url string) <-chan string {
+	body := make(chan string, 1)
+	go func() {
+		res, err := http.Get(url)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		body <- string(b)
+	}()
+	return body
+}
+
+func TestServeHTTP(t *testing.T) {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+
+	started, finished := make(chan struct{}, 1), make(chan struct{}, 1)
+	addr, done := serveAsync(t, ctx, HTTP("127.0.0.1:0"), GracefulWait(time.Second),
+		Handler(draining(started, finished, 100*time.Millisecond)))
+	body := getAsync(t, "http://"+addr)
+	<-started
+	cancelFn()
+
+	if err := result(t, done); !errors.Is(err, context.Canceled) {
+		t.Errorf("ServeHTTP returned %v, expected %v", err, context.Canceled)
+	}
+	select {
+	case <-finished:
+	default:
+		t.Errorf("ServeHTTP returned before the request in progress finished")
+	}
+	if b := <-body; b != "<nil>" {
+		t.Errorf("the request in progress received %q, expected its context not to be canceled", b)
+	}
+}
+
+// stuck returns a handler that signals on started when it receives a request, and waits until release is closed,
+// regardless of its context
+func stuck(started chan<- struct{}, release <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+}
+
+func TestShutdownErrorActive(t *testing.T) {
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	defer close(release)
+	ts := startServer(t, HTTP("127.0.0.1:0"), GracefulWait(50*time.Millisecond), Handler(stuck(started, release)))
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for i := 0; i < 2; i++ {
+		go client.Get(ts.url("http", 0))
+		<-started
+	}
+	var serr ShutdownError
+	if err := ts.stop(t); !errors.As(err, &serr) {
+		t.Fatalf("Run returned %v, expected a ShutdownError", err)
+	}
+	if serr.Active != 2 {
+		t.Errorf("the shutdown reported %d active connections, expected 2", serr.Active)
+	}
+	if !errors.Is(serr, context.DeadlineExceeded) {
+		t.Errorf("the shutdown failed with %v, expected %v", serr.Err, context.DeadlineExceeded)
+	}
+}
+
+func TestWithShutdownTimeout(t *testing.T) {
+	t.Run("after graceful wait", func(t *testing.T) {
+		// the request ignores its context getting canceled, and finishes in the shutdown timeout
+		started, finished := make(chan struct{}, 1), make(chan struct{}, 1)
+		ts := startServer(t, HTTP("127.0.0.1:0"), GracefulWait(100*time.Millisecond), WithShutdownTimeout(time.Second),
+			Handler(draining(started, finished, 300*time.Millisecond)))
+
+		body := getAsync(t, ts.url("http", 0))
+		<-started
+		if err := ts.stop(t); err != nil {
+			t.Errorf("Run returned %v, expected no error", err)
+		}
+		if b := <-body; b != context.Canceled.Error() {
+			t.Errorf("the request in progress received %q, expected it to complete after its context got canceled", b)
+		}
+	})
+	t.Run("without graceful wait", func(t *testing.T) {
+		// the request's context gets canceled when the shutdown starts, and it has the shutdown timeout to clean up
+		started := make(chan struct{}, 1)
+		ts := startServer(t, HTTP("127.0.0.1:0"), WithShutdownTimeout(500*time.Millisecond),
+			Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				started <- struct{}{}
+				select {
+				case <-r.Context().Done():
+				case <-time.After(testTimeout):
+				}
+				time.Sleep(100 * time.Millisecond)
+				fmt.Fprint(w, r.Context().Err())
+			})))
+
+		body := getAsync(t, ts.url("http", 0))
+		<-started
+		if err := ts.stop(t); err != nil {
+			t.Errorf("Run returned %v, expected no error", err)
+		}
+		if b := <-body; b != context.Canceled.Error() {
+			t.Errorf("the request in progress received %q, expected it to complete after its context got canceled", b)
+		}
+	})
+	t.Run("hung", func(t *testing.T) {
+		started, release := make(chan struct{}, 1), make(chan struct{})
+		defer close(release)
+		ts := startServer(t, HTTP("127.0.0.1:0"), GracefulWait(50*time.Millisecond), WithShutdownTimeout(100*time.Millisecond),
+			Handler(stuck(started, release)))
+
+		body := getAsync(t, ts.url("http", 0))
+		<-started
+		begin := time.Now()
+		var serr ShutdownError
+		if err := ts.stop(t); !errors.As(err, &serr) || serr.Active != 1 {
+			t.Errorf("Run returned %v, expected a ShutdownError with one active connection", err)
+		}
+		if d := time.Since(begin); d > time.Second {
+			t.Errorf("the server stopped in %s, expected it to close the connection after 150ms", d)
+		}
+		select {
+		case b := <-body:
+			if !strings.Contains(b, "EOF") {
+				t.Errorf("the request in progress received %q, expected its connection to be closed", b)
+			}
+		case <-time.After(testTimeout):
+			t.Errorf("the connection of the request in progress has not been closed")
+		}
+	})
+	if _, err := NewServer(HTTP("127.0.0.1:0"), WithShutdownTimeout(0)); err == nil {
+		t.Errorf("NewServer succeeded with a zero shutdown timeout")
+	}
+}
+
+func TestForceStop(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	ts := startServer(t, HTTP("127.0.0.1:0"), GracefulWait(testTimeout), Handler(stuck(started, release)))
+
+	reqErr := make(chan error, 1)
+	go func() {
+		res, err := http.Get(ts.url("http", 0))
+		if err == nil {
+			res.Body.Close()
+		}
+		reqErr <- err
+	}()
+	<-started
+
+	begin := time.Now()
+	if err := ts.ForceStop(); err != nil {
+		t.Errorf("ForceStop returned %v, expected no error", err)
+	}
+	if err := ts.wait(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+	if d := time.Since(begin); d > time.Second {
+		t.Errorf("the server stopped in %s, expected it to not wait for the request in progress", d)
+	}
+	select {
+	case err := <-reqErr:
+		if err == nil {
+			t.Errorf("the request in progress succeeded, expected its connection to be closed")
+		}
+	case <-time.After(testTimeout):
+		t.Errorf("the request in progress didn't end after ForceStop")
+	}
+}
+
+func TestWithOnShutdown(t *testing.T) {
+	started, finished := make(chan struct{}, 1), make(chan struct{}, 1)
+	cleanupErr := errors.New("cleanup failed")
+	var calls []string
+	ts := startServer(t, HTTP("127.0.0.1:0"), GracefulWait(time.Second),
+		Handler(draining(started, finished, 100*time.Millisecond)),
+		WithOnShutdown(func(ctx context.Context) error {
+			select {
+			case <-finished:
+				calls = append(calls, "after the request")
+			default:
+				calls = append(calls, "before the request finished")
+			}
+			return nil
+		}),
+		WithOnShutdown(func(ctx context.Context) error {
+			calls = append(calls, "second")
+			return cleanupErr
+		}))
+	addr := ts.addrs[0].String()
+
+	body := getAsync(t, ts.url("http", 0))
+	<-started
+	if err := ts.stop(t); !errors.Is(err, cleanupErr) {
+		t.Errorf("Run returned %v, expected the error of the callback", err)
+	}
+	if b := <-body; b != "<nil>" {
+		t.Errorf("the request in progress received %q, expected it to complete", b)
+	}
+	if len(calls) != 2 || calls[0] != "after the request" || calls[1] != "second" {
+		t.Errorf("the callbacks have been called %q, expected both, after the request finished", calls)
+	}
+	checkReleased(t, addr)
+}
+
+func TestWithRegisterOnShutdown(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	ts := startServer(t, HTTP("127.0.0.1:0"), GracefulWait(time.Second),
+		WithRegisterOnShutdown(func() { close(release) }), Handler(stuck(started, release)))
+
+	// the request in progress gets to finish only if the callback is called when the shutdown starts
+	body := getAsync(t, ts.url("http", 0))
+	<-started
+	if err := ts.stop(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+	if b := <-body; b != "" {
+		t.Errorf("the request in progress received %q, expected it to complete", b)
+	}
+}
+
+// freeAddr returns a local TCP address which is not in use
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// checkReleased fails the test if addr can't be listened on, because it's still in use
+func checkReleased(t *testing.T, addr string) {
+	t.Helper()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Errorf("the listener on %s has not been closed: %s", addr, err)
+		return
+	}
+	l.Close()
+}
+
+func TestOnTCPAddrs(t *testing.T) {
+	ts := startServer(t, OnTCPAddrs("127.0.0.1:0", "127.0.0.1:0"), Handler(hello))
+	if len(ts.addrs) != 2 {
+		t.Fatalf("the server listens on %v, expected two addresses", ts.addrs)
+	}
+	for i := range ts.addrs {
+		if body := get(t, http.DefaultClient, ts.url("http", i)); body != "hello" {
+			t.Errorf("received %q on %s, expected %q", body, ts.addrs[i], "hello")
+		}
+	}
+
+	addr := freeAddr(t)
+	if _, err := NewServer(OnTCPAddrs(addr, "127.0.0.1:invalid")); err == nil {
+		t.Fatalf("NewServer succeeded with an invalid address")
+	}
+	checkReleased(t, addr)
+}
+
+func TestSetterErrorClosesListeners(t *testing.T) {
+	addr := freeAddr(t)
+	invalid := filepath.Join(t.TempDir(), "missing", "wrapper.sock")
+	if _, err := NewServer(HTTP(addr), OnSocket(invalid)); err == nil {
+		t.Fatalf("NewServer succeeded with a socket in a missing directory")
+	}
+	checkReleased(t, addr)
+
+	start, _ := HttpServer(context.Background(), HTTP(addr), OnSocket(invalid))
+	if err := start(); err == nil {
+		t.Errorf("the start function of HttpServer succeeded with a socket in a missing directory")
+	}
+	checkReleased(t, addr)
+}
+
+func TestShutdownRefusesConnections(t *testing.T) {
+	started, finished, stopping := make(chan struct{}, 1), make(chan struct{}, 1), make(chan struct{})
+	ts := startServer(t, HTTP("127.0.0.1:0"), GracefulWait(time.Second),
+		WithRegisterOnShutdown(func() { close(stopping) }),
+		Handler(draining(started, finished, 200*time.Millisecond)))
+
+	body := getAsync(t, ts.url("http", 0))
+	<-started
+	ts.cancelFn()
+	<-stopping
+	if conn, err := net.Dial("tcp", ts.addrs[0].String()); err == nil {
+		conn.Close()
+		t.Errorf("a new connection has been accepted after the shutdown started")
+	}
+	if b := <-body; b != "<nil>" {
+		t.Errorf("the request in progress received %q, expected it to complete", b)
+	}
+	if err := ts.wait(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	ts := startServer(t, HTTP("127.0.0.1:0"), Handler(hello))
+	get(t, http.DefaultClient, ts.url("http", 0))
+	if err := ts.stop(t); err != nil {
+		t.Errorf("Run returned %v after a clean shutdown, expected no error", err)
+	}
+
+	// a listener failing ends Run with its error, without canceling the context
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	ts = startServer(t, WithListener(l), Handler(hello))
+	get(t, http.DefaultClient, "http://"+l.Addr().String())
+	l.Close()
+	if err = ts.wait(t); !errors.As(err, &ListenerError{}) {
+		t.Errorf("Run returned %v, expected a ListenerError", err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	const gWait = time.Second
+	started, stopping, remaining := make(chan struct{}, 1), make(chan struct{}), make(chan time.Duration, 1)
+	ts := startServer(t, HTTP("127.0.0.1:0"), GracefulWait(gWait),
+		WithRegisterOnShutdown(func() { close(stopping) }),
+		Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-stopping
+			if d, ok := r.Context().Deadline(); ok {
+				remaining <- time.Until(d)
+			}
+		})))
+
+	go http.Get(ts.url("http", 0))
+	<-started
+	if err := ts.stop(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+	select {
+	case d := <-remaining:
+		if d <= gWait-200*time.Millisecond || d > gWait {
+			t.Errorf("the request had %s left, expected about %s", d, gWait)
+		}
+	default:
+		t.Errorf("the request context has no deadline during the shutdown")
+	}
+}
+
+func TestGracefulWaitIdle(t *testing.T) {
+	ts := startServer(t, HTTP("127.0.0.1:0"), GracefulWait(testTimeout), Handler(hello))
+	// the idle keep-alive connection doesn't delay the shutdown either
+	if body := get(t, http.DefaultClient, ts.url("http", 0)); body != "hello" {
+		t.Errorf("received %q, expected %q", body, "hello")
+	}
+
+	begin := time.Now()
+	if err := ts.stop(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+	if d := time.Since(begin); d > time.Second {
+		t.Errorf("the server stopped in %s without requests in progress, expected it to not wait", d)
+	}
+}
+
+func TestOnTCP4(t *testing.T) {
+	c, err := newServer(context.Background(), OnTCP4(":0"))
+	if err != nil {
+		t.Fatalf("unable to create the server: %s", err)
+	}
+	defer c.forceStop()
+	if addr := c.l[0].Addr().(*net.TCPAddr); addr.IP.To4() == nil {
+		t.Errorf("the server listens on %s, expected an IPv4 address", addr)
+	}
+}
+
+func TestOnTCP6(t *testing.T) {
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 is not available: %s", err)
+	} else {
+		l.Close()
+	}
+	c, err := newServer(context.Background(), OnTCP6("[::1]:0"))
+	if err != nil {
+		t.Fatalf("unable to create the server: %s", err)
+	}
+	defer c.forceStop()
+	if addr := c.l[0].Addr().(*net.TCPAddr); addr.IP.To4() != nil {
+		t.Errorf("the server listens on %s, expected an IPv6 address", addr)
+	}
+	if _, err = NewServer(OnTCP6("127.0.0.1:0")); err == nil {
+		t.Errorf("NewServer succeeded listening on an IPv4 address with OnTCP6")
+	}
+}
+
+func TestOnTCPInvalidAddress(t *testing.T) {
+	for _, addr := range []string{"localhost:notaport", "localhost", "127.0.0.1:99999"} {
+		_, err := NewServer(HTTP(addr))
+		if err == nil {
+			t.Errorf("NewServer succeeded listening on %q", addr)
+			continue
+		}
+		if msg := err.Error(); !strings.Contains(msg, "OnTCP") || !strings.Contains(msg, addr) {
+			t.Errorf("the error %q doesn't mention OnTCP and the address %q", msg, addr)
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+	_, err = NewServer(HTTP(addr))
+	if err == nil || !strings.Contains(err.Error(), addr) {
+		t.Errorf("NewServer returned %v listening on the address in use %q, expected an error mentioning it", err, addr)
+	}
+	if opErr := (*net.OpError)(nil); !errors.As(err, &opErr) {
+		t.Errorf("the error %v doesn't wrap the error of net.Listen", err)
+	}
+}
+
+func TestWithLogf(t *testing.T) {
+	logger := &testLogger{}
+	ts := startServer(t, HTTP("127.0.0.1:0"), WithLogf(logger.Printf))
+	if err := ts.stop(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+
+	logger.m.Lock()
+	defer logger.m.Unlock()
+	log := strings.Join(logger.lines, "\n")
+	for _, line := range []string{"listening on " + ts.addrs[0].String(), "shutting down", "shutdown complete"} {
+		if !strings.Contains(log, line) {
+			t.Errorf("the log doesn't contain %q:\n%s", line, log)
+		}
+	}
+}
+
+func TestServeErrorNoGoroutineLeak(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	for i := 0; i < 20; i++ {
+		// the closed listener fails as soon as it starts being served
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unable to listen: %s", err)
+		}
+		l.Close()
+		s, err := NewServer(HTTP("127.0.0.1:0"), OnAdmin("127.0.0.1:0", hello), WithListener(l), Handler(hello))
+		if err != nil {
+			t.Fatalf("unable to create the server: %s", err)
+		}
+		if err = s.Run(context.Background()); !errors.As(err, &ListenerError{}) {
+			t.Fatalf("Run returned %v, expected a ListenerError", err)
+		}
+	}
+}
+
+// serverCertName connects to the TLS listener at addr requesting serverName, returning the first name
+// of the certificate the server chose
+func serverCertName(t *testing.T, addr net.Addr, serverName string) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr.String(), &tls.Config{InsecureSkipVerify: true, ServerName: serverName})
+	if err != nil {
+		t.Fatalf("the TLS handshake for %q failed: %s", serverName, err)
+	}
+	defer conn.Close()
+	cert := conn.ConnectionState().PeerCertificates[0]
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.IPAddresses[0].String()
+}
+
+func TestMultipleCertificates(t *testing.T) {
+	ts := startServer(t, WithTLS(HTTP("127.0.0.1:0")), WithSelfSignedCert("a.example"), WithSelfSignedCert("b.example"))
+	for _, name := range []string{"a.example", "b.example"} {
+		if got := serverCertName(t, ts.addrs[0], name); got != name {
+			t.Errorf("the server chose the certificate for %q, for the server name %q", got, name)
+		}
+	}
+
+	// the certificate passed to HTTPS is the default one
+	cert, key := testCertFiles(t)
+	ts = startServer(t, HTTPS("127.0.0.1:0", cert, key), WithSelfSignedCert("b.example"))
+	if got := serverCertName(t, ts.addrs[0], "b.example"); got != "b.example" {
+		t.Errorf("the server chose the certificate for %q, for the server name %q", got, "b.example")
+	}
+	if got := serverCertName(t, ts.addrs[0], ""); got != "127.0.0.1" {
+		t.Errorf("the server chose the certificate for %q without a server name, expected the HTTPS one", got)
+	}
+}
+
+func TestOnAdmin(t *testing.T) {
+	admin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "admin")
+	})
+	ts := startServer(t, HTTP("127.0.0.1:0"), OnAdmin("127.0.0.1:0", admin), WithProxyProtocol(), WithMaxConns(1),
+		Handler(hello))
+	public, private := ts.addrs[0].String(), ts.addrs[1].String()
+
+	if _, body := proxyRequest(t, public, []byte("PROXY TCP4 192.0.2.1 10.0.0.1 4321 443\r\n")); body != "hello" {
+		t.Errorf("the public listener responded with %q, expected %q", body, "hello")
+	}
+	// the listener wrappers of the public listener don't apply to the admin one
+	if status, _ := proxyRequest(t, public, nil); status != http.StatusBadRequest {
+		t.Errorf("the public listener responded with %d without a PROXY header, expected %d", status, http.StatusBadRequest)
+	}
+	idle, err := net.Dial("tcp", private)
+	if err != nil {
+		t.Fatalf("unable to connect to the admin listener: %s", err)
+	}
+	defer idle.Close()
+	if status, body := proxyRequest(t, private, nil); status != http.StatusOK || body != "admin" {
+		t.Errorf("the admin listener responded with %d %q, expected %d %q", status, body, http.StatusOK, "admin")
+	}
+}
+
+func TestOnAdminShutdownError(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	ts := startServer(t, HTTP("127.0.0.1:0"), OnAdmin("127.0.0.1:0", stuck(started, release)),
+		GracefulWait(50*time.Millisecond), Handler(hello))
+	public := ts.addrs[0].String()
+
+	go http.Get(ts.url("http", 1))
+	<-started
+	// the main server gets shut down, even if the admin one fails to
+	if err := ts.stop(t); !errors.As(err, &ShutdownError{}) {
+		t.Errorf("Run returned %v, expected a ShutdownError", err)
+	}
+	checkReleased(t, public)
+}
+
+func TestListenerErrorDrains(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	started, finished, stopping := make(chan struct{}, 1), make(chan struct{}, 1), make(chan struct{})
+	ts := startServer(t, HTTP("127.0.0.1:0"), WithListener(l), GracefulWait(time.Second),
+		WithRegisterOnShutdown(func() { close(stopping) }),
+		Handler(draining(started, finished, 200*time.Millisecond)))
+
+	inFlight := getAsync(t, ts.url("http", 0))
+	<-started
+	l.Close()
+	<-stopping
+	// the other listener is shut down gracefully
+	if conn, err := net.Dial("tcp", ts.addrs[0].String()); err == nil {
+		conn.Close()
+		t.Errorf("a new connection has been accepted after the listener failed")
+	}
+	if body := <-inFlight; body != "<nil>" {
+		t.Errorf("the request in progress received %q, expected it to complete", body)
+	}
+	var lerr ListenerError
+	if err = ts.wait(t); !errors.As(err, &lerr) || lerr.Addr.String() != l.Addr().String() {
+		t.Errorf("Run returned %v, expected a ListenerError for %s", err, l.Addr())
+	}
+}
+
+func TestWithoutHTTP2(t *testing.T) {
+	ts := startServer(t, HTTP("127.0.0.1:0"), WithTLS(HTTP("127.0.0.1:0")), WithSelfSignedCert(), WithoutHTTP2(), Handler(proto))
+
+	client := tlsClient(nil)
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+	res, err := client.Get(ts.url("https", 1))
+	if err != nil {
+		t.Fatalf("the TLS request failed: %s", err)
+	}
+	res.Body.Close()
+	if res.Proto != "HTTP/1.1" {
+		t.Errorf("the request has been served over %s, expected HTTP/1.1", res.Proto)
+	}
+	if p := res.TLS.NegotiatedProtocol; p != "http/1.1" {
+		t.Errorf("the negotiated protocol is %q, expected http/1.1", p)
+	}
+	// HTTP/2 is disabled for the clients which offer only it too
+	conn, err := tls.Dial("tcp", ts.addrs[1].String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	if err == nil {
+		if p := conn.ConnectionState().NegotiatedProtocol; p == "h2" {
+			t.Errorf("HTTP/2 has been negotiated")
+		}
+		conn.Close()
+	}
+}
+
+func TestWithALPN(t *testing.T) {
+	echo := func(conn *tls.Conn) {
+		io.Copy(conn, conn)
+	}
+	ts := startServer(t, WithTLS(HTTP("127.0.0.1:0")), WithSelfSignedCert(), Handler(proto),
+		WithALPN([]string{"echo/1"}, map[string]func(*tls.Conn){"echo/1": echo}))
+
+	conn, err := tls.Dial("tcp", ts.addrs[0].String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"echo/1", "h2"}})
+	if err != nil {
+		t.Fatalf("the TLS handshake failed: %s", err)
+	}
+	defer conn.Close()
+	if p := conn.ConnectionState().NegotiatedProtocol; p != "echo/1" {
+		t.Errorf("the negotiated protocol is %q, expected echo/1", p)
+	}
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("unable to write to the connection: %s", err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("received %q, %v, expected the custom handler to echo %q", buf, err, "ping")
+	}
+
+	// the HTTP protocols are still negotiated with the clients which don't support the custom one
+	client := tlsClient(nil)
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+	res, err := client.Get(ts.url("https", 0))
+	if err != nil {
+		t.Fatalf("the TLS request failed: %s", err)
+	}
+	res.Body.Close()
+	if res.Proto != "HTTP/2.0" {
+		t.Errorf("the request has been served over %s, expected HTTP/2.0", res.Proto)
+	}
+
+	if _, err = NewServer(WithTLS(HTTP("127.0.0.1:0")), WithSelfSignedCert(),
+		WithALPN(nil, map[string]func(*tls.Conn){"echo/1": echo})); err == nil {
+		t.Errorf("NewServer succeeded with a handler for a protocol which is not negotiated")
+	}
+}
+
+func TestListenerError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	l.Close()
+	s, err := NewServer(HTTP("127.0.0.1:0"), WithListener(l))
+	if err != nil {
+		t.Fatalf("unable to create the server: %s", err)
+	}
+	err = s.Run(context.Background())
+
+	var lerr ListenerError
+	if !errors.As(err, &lerr) {
+		t.Fatalf("Run returned %v, expected a ListenerError", err)
+	}
+	if lerr.Addr.String() != l.Addr().String() {
+		t.Errorf("the ListenerError is for %s, expected %s", lerr.Addr, l.Addr())
+	}
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("the ListenerError %v doesn't wrap the error of the listener", err)
+	}
+	if msg := lerr.Error(); !strings.Contains(msg, "error on listener "+l.Addr().String()) {
+		t.Errorf("the error message %q doesn't contain the listener address", msg)
+	}
+}
+
+// ctxKey is the type of the keys of the context values set by the tests
+type ctxKey string
+
+func TestWithBaseContext(t *testing.T) {
+	values := make(chan interface{}, 1)
+	started, canceled := make(chan struct{}, 1), make(chan error, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values <- r.Context().Value(ctxKey("listener"))
+		blocking(started, canceled).ServeHTTP(w, r)
+	})
+	ts := startServer(t, HTTP("127.0.0.1:0"), GracefulWait(50*time.Millisecond), Handler(handler),
+		WithBaseContext(func(l net.Listener) context.Context {
+			// the cancellation of the returned context is ignored
+			ctx, cancelFn := context.WithCancel(context.WithValue(context.Background(), ctxKey("listener"), l.Addr().String()))
+			cancelFn()
+			return ctx
+		}))
+
+	go http.Get(ts.url("http", 0))
+	<-started
+	if v := <-values; v != ts.addrs[0].String() {
+		t.Errorf("the request context has the value %v, expected %s", v, ts.addrs[0])
+	}
+	select {
+	case err := <-canceled:
+		t.Fatalf("the request context ended with %v while the server is running", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	// the request context still gets canceled by the shutdown
+	ts.stop(t)
+	select {
+	case err := <-canceled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("the request context ended with %v, expected %v", err, context.Canceled)
+		}
+	case <-time.After(testTimeout):
+		t.Errorf("the request context has not been canceled")
+	}
+}
+
+func TestWithConnContext(t *testing.T) {
+	ctxValues := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%v %v", r.Context().Value(ctxKey("base")), r.Context().Value(ctxKey("conn")))
+	})
+	ts := startServer(t, HTTP("127.0.0.1:0"), Handler(ctxValues),
+		WithBaseContext(func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), ctxKey("base"), "base")
+		}),
+		WithConnContext(func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, ctxKey("conn"), c.RemoteAddr().String())
+		}))
+
+	conn, err := net.Dial("tcp", ts.addrs[0].String())
+	if err != nil {
+		t.Fatalf("unable to connect: %s", err)
+	}
+	defer conn.Close()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return conn, nil
+		},
+	}}
+	// both requests are sent on the same connection
+	for i := 0; i < 2; i++ {
+		if body, expected := get(t, client, ts.url("http", 0)), "base "+conn.LocalAddr().String(); body != expected {
+			t.Errorf("the request context has the values %q, expected %q", body, expected)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+//go:build unix
+
+package wrapper
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// unixClient returns a client that sends all the requests to the unix socket at path
+func unixClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+func TestOnSocketMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wrapper.sock")
+	startServer(t, OnSocketMode(path, 0600), Handler(hello))
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("unable to stat the socket: %s", err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Errorf("the socket has mode %s, expected %s", mode, os.FileMode(0600))
+	}
+	if body := get(t, unixClient(path), "http://unix/"); body != "hello" {
+		t.Errorf("received %q, expected %q", body, "hello")
+	}
+}
+
+func TestReadyCallbackSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wrapper.sock")
+	ts := startServer(t, HTTP("127.0.0.1:0"), OnSocket(path), Handler(hello))
+	if len(ts.addrs) != 2 {
+		t.Fatalf("the ready callback received %v, expected two addresses", ts.addrs)
+	}
+	addr, ok := ts.addrs[1].(*net.UnixAddr)
+	if !ok || addr.Name != path {
+		t.Fatalf("the ready callback received %v, expected the unix address %s", ts.addrs[1], path)
+	}
+	if body := get(t, unixClient(addr.Name), "http://unix/"); body != "hello" {
+		t.Errorf("received %q, expected %q", body, "hello")
+	}
+	if err := ts.stop(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+}
+
+func TestSocketRemoved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wrapper.sock")
+	ts := startServer(t, OnSocket(path))
+	if err := ts.stop(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the socket file has not been removed: %v", err)
+	}
+
+	// the sockets passed by another process, like systemd, are managed by it
+	path = filepath.Join(t.TempDir(), "inherited.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("unable to listen on the socket: %s", err)
+	}
+	l.SetUnlinkOnClose(false)
+	defer l.Close()
+	f, err := l.File()
+	if err != nil {
+		t.Fatalf("unable to get the file of the listener: %s", err)
+	}
+	defer f.Close()
+	// OnFd closes the file descriptor it receives
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatalf("unable to duplicate the file descriptor: %s", err)
+	}
+	ts = startServer(t, OnFd(uintptr(fd), "inherited"))
+	if err = ts.stop(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+	if _, err = os.Stat(path); err != nil {
+		t.Errorf("the inherited socket file has been removed: %v", err)
+	}
+}
+
+func TestServeHTTPSignal(t *testing.T) {
+	started, finished := make(chan struct{}, 1), make(chan struct{}, 1)
+	addr, done := serveAsync(t, context.Background(), HTTP("127.0.0.1:0"), GracefulWait(time.Second),
+		Handler(draining(started, finished, 100*time.Millisecond)))
+	body := getAsync(t, "http://"+addr)
+	<-started
+	kill(t, syscall.SIGTERM)
+
+	if err := result(t, done); err != nil {
+		t.Errorf("ServeHTTP returned %v, expected no error", err)
+	}
+	select {
+	case <-finished:
+	default:
+		t.Errorf("ServeHTTP returned before the request in progress finished")
+	}
+	if b := <-body; b != "<nil>" {
+		t.Errorf("the request in progress received %q, expected it to be drained", b)
+	}
+}
+
+func TestPlaintextSocketWithTLS(t *testing.T) {
+	cert, key := testCertFiles(t)
+	setters := map[string][]SetFn{
+		"WithTLS": {WithTLS(HTTP("127.0.0.1:0")), WithSelfSignedCert()},
+		"HTTPS":   {HTTPS("127.0.0.1:0", cert, key)},
+	}
+	for name, tlsSetters := range setters {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "wrapper.sock")
+			ts := startServer(t, append([]SetFn{OnSocket(path), Handler(hello)}, tlsSetters...)...)
+
+			if body := get(t, unixClient(path), "http://unix/"); body != "hello" {
+				t.Errorf("received %q on the unix socket, expected the plaintext response %q", body, "hello")
+			}
+			if body := get(t, tlsClient(nil), ts.url("https", 1)); body != "hello" {
+				t.Errorf("received %q on the TCP listener, expected the TLS response %q", body, "hello")
+			}
+			res, err := http.Get(ts.url("http", 1))
+			if err != nil {
+				t.Fatalf("the plaintext request to the TLS listener failed: %s", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusBadRequest {
+				t.Errorf("the plaintext request to the TLS listener returned %s, expected %d", res.Status, http.StatusBadRequest)
+			}
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "wrapper.sock")
+	if _, err := NewServer(OnSocket(path), WithSelfSignedCert()); err == nil {
+		t.Errorf("NewServer succeeded with a certificate, but only a plaintext listener")
+	}
+	if _, err := NewServer(WithTLS(OnSocket(path))); err == nil {
+		t.Errorf("NewServer succeeded with a TLS listener, but no certificate")
+	}
+}
+
+func TestHTTPSInvalidFiles(t *testing.T) {
+	cert, key := testCertFiles(t)
+	dir := t.TempDir()
+
+	type files struct {
+		cert, key string
+		err       error
+	}
+	tests := map[string]files{
+		"missing certificate": {filepath.Join(dir, "missing.pem"), key, os.ErrNotExist},
+		"missing key":         {cert, filepath.Join(dir, "missing.pem"), os.ErrNotExist},
+		"directory":           {dir, key, nil},
+	}
+	if os.Geteuid() != 0 {
+		// root can read the files regardless of their mode
+		unreadable := filepath.Join(dir, "unreadable.pem")
+		if err := os.WriteFile(unreadable, nil, 0); err != nil {
+			t.Fatalf("unable to write the file: %s", err)
+		}
+		tests["unreadable certificate"] = files{unreadable, key, os.ErrPermission}
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := HTTPS("127.0.0.1:0", tt.cert, tt.key)(&c{})
+			if err == nil {
+				t.Fatalf("HTTPS succeeded with %s", name)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("HTTPS returned %v, expected %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestServeHTTPRestoresSignals(t *testing.T) {
+	if isChild(t) {
+		// SIGWINCH is ignored by default, so it can be sent until the handlers have been registered
+		handling := make(chan struct{}, 1)
+		done := make(chan error, 1)
+		go func() {
+			done <- ServeHTTP(context.Background(), SignalHandlers{syscall.SIGWINCH: func(chan int) {
+				select {
+				case handling <- struct{}{}:
+				default:
+				}
+			}}, HTTP("127.0.0.1:0"))
+		}()
+		for registered := false; !registered; {
+			kill(t, syscall.SIGWINCH)
+			select {
+			case <-handling:
+				registered = true
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		kill(t, syscall.SIGTERM)
+		if err := result(t, done); err != nil {
+			t.Errorf("ServeHTTP returned %v, expected no error", err)
+		}
+		// after ServeHTTP returns, SIGTERM terminates the process again
+		kill(t, syscall.SIGTERM)
+		time.Sleep(testTimeout)
+		t.Errorf("the process survived SIGTERM after ServeHTTP returned")
+		return
+	}
+	ch := startChild(t, nil)
+	err := ch.cmd.Wait()
+	status, ok := ch.cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() || status.Signal() != syscall.SIGTERM {
+		t.Errorf("the child process ended with %v, expected it to be terminated by SIGTERM\n%s", err, ch.out.String())
+	}
+}
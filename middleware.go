@@ -0,0 +1,326 @@
+package wrapper
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusWriter records the status code and the size of the response,
+// while still exposing the optional interfaces of the wrapped http.ResponseWriter
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= http.StatusOK {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer doesn't support hijacking")
+	}
+	return h.Hijack()
+}
+
+func (w *statusWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := w.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Unwrap allows http.ResponseController to access the wrapped http.ResponseWriter
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// WithAccessLog writes a line in the common log format to out for every request, with the request duration appended.
+func WithAccessLog(out io.Writer) SetFn {
+	return func(c *c) error {
+		c.wrap = append(c.wrap, accessLog(out))
+		return nil
+	}
+}
+
+func accessLog(out io.Writer) func(http.Handler) http.Handler {
+	m := sync.Mutex{}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+			if sw.status == 0 {
+				sw.status = http.StatusOK
+			}
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+
+			m.Lock()
+			defer m.Unlock()
+			fmt.Fprintf(out, "%s - - [%s] \"%s %s %s\" %d %d %s\n", host, start.Format("02/Jan/2006:15:04:05 -0700"),
+				r.Method, r.RequestURI, r.Proto, sw.status, sw.bytes, time.Since(start))
+		})
+	}
+}
+
+// WithRecover recovers from the panics raised by the handler and calls fn with the recovered value.
+// When fn is nil, the response is a 500 Internal Server Error.
+// The http.ErrAbortHandler panics are not recovered, as they are used to abort the response on purpose.
+func WithRecover(fn func(w http.ResponseWriter, r *http.Request, v interface{})) SetFn {
+	if fn == nil {
+		fn = defaultRecoverFn
+	}
+	return func(c *c) error {
+		c.wrap = append(c.wrap, recoverHandler(fn))
+		return nil
+	}
+}
+
+func defaultRecoverFn(w http.ResponseWriter, _ *http.Request, _ interface{}) {
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+func recoverHandler(fn func(http.ResponseWriter, *http.Request, interface{})) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				fn(w, r, v)
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithHandlerTimeout makes the requests that take longer than d to be handled return 503 Service Unavailable,
+// with msg as the body. It wraps the handler before any other SetFn, so they see the timed out response.
+func WithHandlerTimeout(d time.Duration, msg string) SetFn {
+	return func(c *c) error {
+		if d <= 0 {
+			return fmt.Errorf("invalid handler timeout %s", d)
+		}
+		timeout := func(next http.Handler) http.Handler {
+			return http.TimeoutHandler(next, d, msg)
+		}
+		c.wrap = append([]func(http.Handler) http.Handler{timeout}, c.wrap...)
+		return nil
+	}
+}
+
+// WithHSTS adds the Strict-Transport-Security header to the responses of the requests received over TLS.
+// A Strict-Transport-Security header set by the handler replaces it.
+func WithHSTS(maxAge time.Duration, includeSubdomains, preload bool) SetFn {
+	return func(c *c) error {
+		if maxAge < 0 {
+			return fmt.Errorf("invalid HSTS max-age %s", maxAge)
+		}
+		value := fmt.Sprintf("max-age=%d", int64(maxAge/time.Second))
+		if includeSubdomains {
+			value += "; includeSubDomains"
+		}
+		if preload {
+			value += "; preload"
+		}
+		c.wrap = append(c.wrap, hsts(value))
+		return nil
+	}
+}
+
+func hsts(value string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// the header is set before calling the handler, so the value it sets takes precedence
+			if h := w.Header(); r.TLS != nil && h.Get("Strict-Transport-Security") == "" {
+				h.Set("Strict-Transport-Security", value)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithTrustedProxies replaces the remote address of the requests received from the proxies in the cidrs networks
+// with the client address in their X-Forwarded-For header: the rightmost address that isn't a trusted proxy.
+// The header of the requests received from other peers is ignored.
+// It's applied before the other handler wrappers, so they all get the client address.
+func WithTrustedProxies(cidrs []string) SetFn {
+	return func(c *c) error {
+		nets := make([]*net.IPNet, 0, len(cidrs))
+		for _, cidr := range cidrs {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("invalid trusted proxy network: %w", err)
+			}
+			nets = append(nets, n)
+		}
+		c.trusted = trustedProxies(nets)
+		return nil
+	}
+}
+
+func trustedProxies(nets []*net.IPNet) func(http.Handler) http.Handler {
+	trusted := func(ip net.IP) bool {
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			if peer := net.ParseIP(host); peer != nil && trusted(peer) {
+				if client := forwardedFor(r.Header.Values("X-Forwarded-For"), trusted); client != nil {
+					r = r.WithContext(r.Context())
+					r.RemoteAddr = client.String()
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedFor returns the rightmost address in the X-Forwarded-For values that isn't trusted,
+// or the leftmost one if all of them are.
+// It returns nil if the values contain an invalid address, as we can't know who added it.
+func forwardedFor(values []string, trusted func(net.IP) bool) net.IP {
+	var addrs []string
+	for _, v := range values {
+		addrs = append(addrs, strings.Split(v, ",")...)
+	}
+	var client net.IP
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(addrs[i]))
+		if ip == nil {
+			return nil
+		}
+		client = ip
+		if !trusted(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// WithHealthEndpoints responds to the requests for the ready and live paths, before they get to the handler.
+// The ready path responds with 200 OK while the server is running, and 503 Service Unavailable once its shutdown
+// has started, the live path always responds with 200 OK. Empty paths are not served.
+// WithDrainDelay keeps the listeners open for a while after the server stops being ready, so the load
+// balancers find out before the server stops accepting connections.
+func WithHealthEndpoints(ready, live string) SetFn {
+	return func(c *c) error {
+		c.wrap = append(c.wrap, func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case ready != "" && r.URL.Path == ready:
+					if c.stopping.Load() {
+						http.Error(w, "shutting down", http.StatusServiceUnavailable)
+						return
+					}
+					io.WriteString(w, "ok\n")
+				case live != "" && r.URL.Path == live:
+					io.WriteString(w, "ok\n")
+				default:
+					next.ServeHTTP(w, r)
+				}
+			})
+		})
+		return nil
+	}
+}
+
+// WithPerRequestDeadline sets the read and write deadlines of every request to the duration returned by fn,
+// from the time the handler starts, overriding ReadWait and WriteWait. A zero duration keeps the server's deadlines.
+func WithPerRequestDeadline(fn func(r *http.Request) time.Duration) SetFn {
+	return func(c *c) error {
+		if fn == nil {
+			return fmt.Errorf("nil request deadline function")
+		}
+		c.wrap = append(c.wrap, func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if d := fn(r); d > 0 {
+					deadline := time.Now().Add(d)
+					rc := http.NewResponseController(w)
+					// the connections that don't support changing them, like the HTTP/3 ones, keep the server's deadlines
+					_ = rc.SetReadDeadline(deadline)
+					_ = rc.SetWriteDeadline(deadline)
+				}
+				next.ServeHTTP(w, r)
+			})
+		})
+		return nil
+	}
+}
+
+// RequestObserver receives the metrics of the requests served, so they can be recorded with any metrics package
+type RequestObserver interface {
+	// ObserveRequest is called after a request has been served
+	ObserveRequest(method, path string, status int, dur time.Duration)
+	// IncInFlight is called when a request starts being served
+	IncInFlight()
+	// DecInFlight is called when a request has been served
+	DecInFlight()
+}
+
+// WithMetrics reports the requests served to obs.
+// The path is the one of the request's URL, so obs should limit the number of distinct values it records.
+func WithMetrics(obs RequestObserver) SetFn {
+	return func(c *c) error {
+		if obs == nil {
+			return fmt.Errorf("nil request observer")
+		}
+		c.wrap = append(c.wrap, func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				obs.IncInFlight()
+				defer obs.DecInFlight()
+
+				start := time.Now()
+				sw := &statusWriter{ResponseWriter: w}
+				next.ServeHTTP(sw, r)
+				if sw.status == 0 {
+					sw.status = http.StatusOK
+				}
+				obs.ObserveRequest(r.Method, r.URL.Path, sw.status, time.Since(start))
+			})
+		})
+		return nil
+	}
+}
@@ -0,0 +1,352 @@
+package wrapper
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// handle serves r with the handler of the server configured by setters, returning the recorded response
+func handle(t *testing.T, r *http.Request, setters ...SetFn) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	configure(t, setters...).s.Handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestWithAccessLog(t *testing.T) {
+	out := bytes.Buffer{}
+	created := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+		if _, ok := w.(http.Flusher); !ok {
+			t.Errorf("the response writer doesn't implement http.Flusher")
+		}
+	})
+	handle(t, httptest.NewRequest(http.MethodPost, "/path?q=1", nil), Handler(created), WithAccessLog(&out))
+
+	line := out.String()
+	if !strings.Contains(line, `"POST /path?q=1 HTTP/1.1" 201 5 `) {
+		t.Errorf("the access log line %q doesn't contain the request, status and size", line)
+	}
+	if !strings.HasSuffix(line, "\n") {
+		t.Errorf("the access log line %q doesn't end with a new line", line)
+	}
+}
+
+func TestWithAccessLogHijack(t *testing.T) {
+	out := bytes.Buffer{}
+	hijack := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("unable to hijack the connection: %s", err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		buf.Flush()
+	})
+	ts := startServer(t, HTTP("127.0.0.1:0"), Handler(hijack), WithAccessLog(&out))
+	if body := get(t, http.DefaultClient, ts.url("http", 0)); body != "hijacked" {
+		t.Errorf("received %q, expected the response written on the hijacked connection", body)
+	}
+}
+
+func TestWithRecover(t *testing.T) {
+	panicking := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("boom")
+	})
+	w := handle(t, httptest.NewRequest(http.MethodGet, "/", nil), Handler(panicking), WithRecover(nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("received %d, expected %d", w.Code, http.StatusInternalServerError)
+	}
+
+	var recovered interface{}
+	w = handle(t, httptest.NewRequest(http.MethodGet, "/", nil), Handler(panicking),
+		WithRecover(func(w http.ResponseWriter, r *http.Request, v interface{}) {
+			recovered = v
+			w.WriteHeader(http.StatusTeapot)
+		}))
+	if recovered != "boom" {
+		t.Errorf("the callback received %v, expected boom", recovered)
+	}
+	if w.Code != http.StatusTeapot {
+		t.Errorf("received %d, expected the status set by the callback", w.Code)
+	}
+}
+
+func TestWithRecoverAbortHandler(t *testing.T) {
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("recovered %v, expected http.ErrAbortHandler to be panicking", v)
+		}
+	}()
+	aborting := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+	handle(t, httptest.NewRequest(http.MethodGet, "/", nil), Handler(aborting), WithRecover(func(http.ResponseWriter, *http.Request, interface{}) {
+		t.Errorf("the callback has been called for http.ErrAbortHandler")
+	}))
+}
+
+func TestWithHandlerTimeout(t *testing.T) {
+	out := bytes.Buffer{}
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(testTimeout):
+		}
+	})
+	w := handle(t, httptest.NewRequest(http.MethodGet, "/", nil), Handler(slow), WithAccessLog(&out),
+		WithHandlerTimeout(20*time.Millisecond, "too slow"))
+
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "too slow" {
+		t.Errorf("received %d %q, expected %d %q", w.Code, w.Body.String(), http.StatusServiceUnavailable, "too slow")
+	}
+	// the access log is applied after the timeout, even if its SetFn comes first
+	if line := out.String(); !strings.Contains(line, `" 503 8 `) {
+		t.Errorf("the access log line %q doesn't contain the timed out response", line)
+	}
+	if _, err := NewServer(HTTP("127.0.0.1:0"), WithHandlerTimeout(0, "")); err == nil {
+		t.Errorf("NewServer succeeded with a zero handler timeout")
+	}
+}
+
+func TestWithHSTS(t *testing.T) {
+	const value = "max-age=31536000; includeSubDomains; preload"
+	setHSTS := WithHSTS(365*24*time.Hour, true, true)
+
+	w := handle(t, httptest.NewRequest(http.MethodGet, "https://example.com/", nil), Handler(hello), setHSTS)
+	if h := w.Header().Get("Strict-Transport-Security"); h != value {
+		t.Errorf("received Strict-Transport-Security %q over TLS, expected %q", h, value)
+	}
+	w = handle(t, httptest.NewRequest(http.MethodGet, "http://example.com/", nil), Handler(hello), setHSTS)
+	if h := w.Header().Get("Strict-Transport-Security"); h != "" {
+		t.Errorf("received Strict-Transport-Security %q over plaintext, expected none", h)
+	}
+
+	custom := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=60")
+	})
+	w = handle(t, httptest.NewRequest(http.MethodGet, "https://example.com/", nil), Handler(custom),
+		WithHSTS(time.Hour, false, false))
+	if h := w.Header().Values("Strict-Transport-Security"); len(h) != 1 || h[0] != "max-age=60" {
+		t.Errorf("received Strict-Transport-Security %q, expected the value set by the handler", h)
+	}
+	if _, err := NewServer(HTTP("127.0.0.1:0"), WithHSTS(-time.Second, false, false)); err == nil {
+		t.Errorf("NewServer succeeded with a negative HSTS max-age")
+	}
+}
+
+// remoteHost is a handler responding with the remote address of the request
+var remoteHost = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, r.RemoteAddr)
+})
+
+func TestWithTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name     string
+		peer     string
+		forwards []string
+		expected string
+	}{
+		{name: "trusted peer", peer: "10.0.0.1:1234", forwards: []string{"203.0.113.7"}, expected: "203.0.113.7"},
+		{name: "untrusted peer", peer: "198.51.100.1:1234", forwards: []string{"203.0.113.7"}, expected: "198.51.100.1:1234"},
+		{name: "spoofed entries", peer: "10.0.0.1:1234", forwards: []string{"1.2.3.4, 203.0.113.7"}, expected: "203.0.113.7"},
+		{name: "chained proxies", peer: "10.0.0.1:1234", forwards: []string{"1.2.3.4", "203.0.113.7, 10.0.0.2"}, expected: "203.0.113.7"},
+		{name: "only proxies", peer: "10.0.0.1:1234", forwards: []string{"10.0.0.3, 10.0.0.2"}, expected: "10.0.0.3"},
+		{name: "invalid entry", peer: "10.0.0.1:1234", forwards: []string{"203.0.113.7, bogus"}, expected: "10.0.0.1:1234"},
+		{name: "no header", peer: "10.0.0.1:1234", expected: "10.0.0.1:1234"},
+		{name: "IPv6 peer", peer: "[fd00::1]:1234", forwards: []string{"2001:db8::7"}, expected: "2001:db8::7"},
+	}
+	setTrusted := WithTrustedProxies([]string{"10.0.0.0/8", "fd00::/8"})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.peer
+			for _, v := range tt.forwards {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if w := handle(t, r, Handler(remoteHost), setTrusted); w.Body.String() != tt.expected {
+				t.Errorf("the handler received the remote address %q, expected %q", w.Body.String(), tt.expected)
+			}
+		})
+	}
+
+	// the access log is applied after the trusted proxies, even if its SetFn comes first
+	out := bytes.Buffer{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	handle(t, r, Handler(remoteHost), WithAccessLog(&out), setTrusted)
+	if line := out.String(); !strings.HasPrefix(line, "203.0.113.7 ") {
+		t.Errorf("the access log line %q doesn't start with the client address", line)
+	}
+	if _, err := NewServer(HTTP("127.0.0.1:0"), WithTrustedProxies([]string{"10.0.0.1"})); err == nil {
+		t.Errorf("NewServer succeeded with an invalid trusted proxy network")
+	}
+}
+
+func TestWithHealthEndpoints(t *testing.T) {
+	started, finished, stopping := make(chan struct{}, 1), make(chan struct{}, 1), make(chan struct{})
+	ts := startServer(t, HTTP("127.0.0.1:0"), GracefulWait(time.Second), WithDrainDelay(500*time.Millisecond),
+		WithHealthEndpoints("/readyz", "/livez"), WithRegisterOnShutdown(func() { close(stopping) }),
+		Handler(draining(started, finished, 200*time.Millisecond)))
+
+	// every check uses a new connection, like a load balancer would
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	status := func(path string) int {
+		res, err := client.Get(ts.url("http", 0) + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %s", path, err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	for _, path := range []string{"/readyz", "/livez"} {
+		if code := status(path); code != http.StatusOK {
+			t.Errorf("%s responded with %d while running, expected %d", path, code, http.StatusOK)
+		}
+	}
+	inFlight := getAsync(t, ts.url("http", 0))
+	<-started
+	ts.cancelFn()
+
+	// the server is not ready before it stops accepting connections
+	code := http.StatusOK
+	for end := time.Now().Add(testTimeout); code == http.StatusOK && time.Now().Before(end); time.Sleep(10 * time.Millisecond) {
+		code = status("/readyz")
+	}
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz responded with %d during the drain delay, expected %d", code, http.StatusServiceUnavailable)
+	}
+	if code = status("/livez"); code != http.StatusOK {
+		t.Errorf("/livez responded with %d during the drain delay, expected %d", code, http.StatusOK)
+	}
+	select {
+	case <-stopping:
+		t.Errorf("the shutdown started before the drain delay ended")
+	default:
+	}
+	<-stopping
+
+	if body := <-inFlight; body != "<nil>" {
+		t.Errorf("the request in progress received %q, expected it to complete", body)
+	}
+	if err := ts.wait(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+	if _, err := NewServer(HTTP("127.0.0.1:0"), WithDrainDelay(0)); err == nil {
+		t.Errorf("NewServer succeeded with a zero drain delay")
+	}
+}
+
+// slowBody is a request body sending size bytes, one every interval
+type slowBody struct {
+	size     int
+	interval time.Duration
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	if b.size == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(b.interval)
+	b.size--
+	p[0] = 'x'
+	return 1, nil
+}
+
+func TestWithPerRequestDeadline(t *testing.T) {
+	ts := startServer(t, HTTP("127.0.0.1:0"), ReadWait(100*time.Millisecond),
+		WithPerRequestDeadline(func(r *http.Request) time.Duration {
+			if r.URL.Path == "/upload" {
+				return testTimeout
+			}
+			return 0
+		}),
+		Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Write(body)
+		})))
+
+	upload := func(path string) (string, error) {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		res, err := client.Post(ts.url("http", 0)+path, "text/plain", &slowBody{size: 6, interval: 50 * time.Millisecond})
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("status %d: %s", res.StatusCode, body)
+		}
+		return string(body), err
+	}
+	if body, err := upload("/upload"); err != nil || body != "xxxxxx" {
+		t.Errorf("the upload with an extended deadline received %q, %v, expected it to succeed", body, err)
+	}
+	if body, err := upload("/"); err == nil {
+		t.Errorf("the upload with the default deadline received %q, expected it to time out", body)
+	}
+}
+
+// fakeObserver records the requests reported by WithMetrics
+type fakeObserver struct {
+	inFlight, maxInFlight int
+	requests              []string
+	durations             []time.Duration
+}
+
+func (o *fakeObserver) ObserveRequest(method, path string, status int, dur time.Duration) {
+	o.requests = append(o.requests, fmt.Sprintf("%s %s %d", method, path, status))
+	o.durations = append(o.durations, dur)
+}
+
+func (o *fakeObserver) IncInFlight() {
+	o.inFlight++
+	if o.inFlight > o.maxInFlight {
+		o.maxInFlight = o.inFlight
+	}
+}
+
+func (o *fakeObserver) DecInFlight() {
+	o.inFlight--
+}
+
+func TestWithMetrics(t *testing.T) {
+	obs := &fakeObserver{}
+	teapot := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handle(t, httptest.NewRequest(http.MethodPost, "/tea", nil), Handler(teapot), WithMetrics(obs))
+
+	if len(obs.requests) != 1 || obs.requests[0] != "POST /tea 418" {
+		t.Fatalf("the observer received %q, expected one request, POST /tea 418", obs.requests)
+	}
+	if obs.durations[0] <= 0 {
+		t.Errorf("the request took %s, expected a positive duration", obs.durations[0])
+	}
+	if obs.maxInFlight != 1 || obs.inFlight != 0 {
+		t.Errorf("the request has been in flight %d times, and is still %d, expected 1 and 0", obs.maxInFlight, obs.inFlight)
+	}
+
+	// the status of the responses which don't set it is 200
+	handle(t, httptest.NewRequest(http.MethodGet, "/", nil), Handler(hello), WithMetrics(obs))
+	if len(obs.requests) != 2 || obs.requests[1] != "GET / 200" {
+		t.Errorf("the observer received %q, expected the second request to be GET / 200", obs.requests)
+	}
+	if _, err := NewServer(HTTP("127.0.0.1:0"), WithMetrics(nil)); err == nil {
+		t.Errorf("NewServer succeeded with a nil observer")
+	}
+}
@@ -0,0 +1,206 @@
+package wrapper
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspFetchTimeout is the time an OCSP responder has to answer
+const ocspFetchTimeout = 10 * time.Second
+
+// WithOCSPStapling staples the OCSP response der to the certificate it has been issued for,
+// which must be one of the server's certificates. It can be called multiple times, for different certificates.
+// A response past its next update time is not served.
+func WithOCSPStapling(der []byte) SetFn {
+	return func(c *c) error {
+		if len(der) == 0 {
+			return fmt.Errorf("empty OCSP response")
+		}
+		c.ocspStaples = append(c.ocspStaples, der)
+		return nil
+	}
+}
+
+// WithOCSPRefresh fetches the OCSP responses for the server's certificates from their OCSP responders
+// every interval, while the server is running, and staples them to the certificates.
+// The certificates must contain their issuer, as the second certificate of the chain.
+func WithOCSPRefresh(interval time.Duration) SetFn {
+	return func(c *c) error {
+		if interval <= 0 {
+			return fmt.Errorf("invalid OCSP refresh interval %s", interval)
+		}
+		c.ocspRefresh = interval
+		return nil
+	}
+}
+
+// stapler serves the server's certificates with their OCSP responses
+type stapler struct {
+	m       sync.RWMutex
+	certs   []tls.Certificate
+	staples []*ocsp.Response
+}
+
+// initOCSP replaces the server's certificates with a stapler serving them
+func (c *c) initOCSP() error {
+	if len(c.ocspStaples) == 0 && c.ocspRefresh == 0 {
+		return nil
+	}
+	cfg := c.s.TLSConfig
+	if cfg.GetCertificate != nil {
+		return fmt.Errorf("OCSP stapling is not supported for certificates loaded by GetCertificate")
+	}
+	if len(cfg.Certificates) == 0 && c.cert != "" && c.key != "" {
+		cert, err := tls.LoadX509KeyPair(c.cert, c.key)
+		if err != nil {
+			return fmt.Errorf("unable to load certificate for OCSP stapling: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if len(cfg.Certificates) == 0 {
+		return fmt.Errorf("OCSP stapling requires a certificate")
+	}
+	st := &stapler{
+		certs:   make([]tls.Certificate, len(cfg.Certificates)),
+		staples: make([]*ocsp.Response, len(cfg.Certificates)),
+	}
+	for i, cert := range cfg.Certificates {
+		if cert.Leaf == nil {
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return fmt.Errorf("invalid certificate: %w", err)
+			}
+			cert.Leaf = leaf
+		}
+		st.certs[i] = cert
+	}
+	for _, der := range c.ocspStaples {
+		if err := st.staple(der); err != nil {
+			return err
+		}
+	}
+	c.ocsp = st
+	// crypto/tls uses the first certificate instead of calling GetCertificate for clients which don't send a server name
+	cfg.Certificates = nil
+	cfg.GetCertificate = st.getCertificate
+	return nil
+}
+
+// staple sets der as the OCSP response of the certificate it has been issued for
+func (st *stapler) staple(der []byte) error {
+	resp, err := ocsp.ParseResponse(der, nil)
+	if err != nil {
+		return fmt.Errorf("invalid OCSP response: %w", err)
+	}
+	st.m.Lock()
+	defer st.m.Unlock()
+	for i, cert := range st.certs {
+		if cert.Leaf.SerialNumber.Cmp(resp.SerialNumber) == 0 {
+			st.staples[i] = resp
+			return nil
+		}
+	}
+	return fmt.Errorf("no certificate with serial number %s for the OCSP response", resp.SerialNumber)
+}
+
+// getCertificate chooses the certificate like the crypto/tls package does when there's no GetCertificate,
+// and returns a copy of it with its OCSP response, if it's still valid
+func (st *stapler) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	st.m.RLock()
+	defer st.m.RUnlock()
+
+	i := 0
+	for j := range st.certs {
+		if hello.SupportsCertificate(&st.certs[j]) == nil {
+			i = j
+			break
+		}
+	}
+	cert := st.certs[i]
+	if resp := st.staples[i]; resp != nil && (resp.NextUpdate.IsZero() || time.Now().Before(resp.NextUpdate)) {
+		cert.OCSPStaple = resp.Raw
+	}
+	return &cert, nil
+}
+
+// refresh fetches the OCSP responses of the certificates every interval, until done is closed
+func (st *stapler) refresh(interval time.Duration, logf func(string, ...interface{}), done <-chan struct{}) {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	go func() {
+		<-done
+		cancelFn()
+	}()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		for i := range st.certs {
+			if err := st.fetch(ctx, i); err != nil {
+				logf("unable to refresh the OCSP response for %s: %s", st.certs[i].Leaf.Subject, err)
+			}
+		}
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// fetch gets the OCSP response for the i-th certificate from its OCSP responder
+func (st *stapler) fetch(ctx context.Context, i int) error {
+	cert := st.certs[i]
+	if len(cert.Leaf.OCSPServer) == 0 {
+		return nil
+	}
+	if len(cert.Certificate) < 2 {
+		return fmt.Errorf("missing issuer certificate")
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return fmt.Errorf("invalid issuer certificate: %w", err)
+	}
+	req, err := ocsp.CreateRequest(cert.Leaf, issuer, nil)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancelFn := context.WithTimeout(ctx, ocspFetchTimeout)
+	defer cancelFn()
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, cert.Leaf.OCSPServer[0], bytes.NewReader(req))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/ocsp-request")
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status %s", res.Status)
+	}
+	der, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	resp, err := ocsp.ParseResponseForCert(der, cert.Leaf, issuer)
+	if err != nil {
+		return fmt.Errorf("invalid OCSP response: %w", err)
+	}
+
+	st.m.Lock()
+	defer st.m.Unlock()
+	st.staples[i] = resp
+	return nil
+}
@@ -0,0 +1,167 @@
+package wrapper
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspResponse creates an OCSP response for cert, signed by its issuer, valid until nextUpdate
+func ocspResponse(t *testing.T, cert, issuer *x509.Certificate, key crypto.Signer, nextUpdate time.Time) []byte {
+	t.Helper()
+	der, err := ocsp.CreateResponse(issuer, issuer, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: cert.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Hour),
+		NextUpdate:   nextUpdate,
+	}, key)
+	if err != nil {
+		t.Fatalf("unable to create the OCSP response: %s", err)
+	}
+	return der
+}
+
+// handshakeOCSP connects to the TLS listener at addr, returning the OCSP response stapled by the server
+func handshakeOCSP(t *testing.T, addr net.Addr) []byte {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr.String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("the TLS handshake failed: %s", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().OCSPResponse
+}
+
+func TestWithOCSPStapling(t *testing.T) {
+	cert, _, _ := testCert(t)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("unable to parse the certificate: %s", err)
+	}
+	key := cert.PrivateKey.(crypto.Signer)
+
+	t.Run("valid", func(t *testing.T) {
+		der := ocspResponse(t, leaf, leaf, key, time.Now().Add(time.Hour))
+		ts := startServer(t, WithTLS(HTTP("127.0.0.1:0")), WithCertificate(cert), WithOCSPStapling(der))
+		if staple := handshakeOCSP(t, ts.addrs[0]); !bytes.Equal(staple, der) {
+			t.Errorf("the handshake contains the OCSP response %x, expected %x", staple, der)
+		}
+	})
+	t.Run("expired", func(t *testing.T) {
+		der := ocspResponse(t, leaf, leaf, key, time.Now().Add(-time.Minute))
+		ts := startServer(t, WithTLS(HTTP("127.0.0.1:0")), WithCertificate(cert), WithOCSPStapling(der))
+		if staple := handshakeOCSP(t, ts.addrs[0]); len(staple) > 0 {
+			t.Errorf("the handshake contains the OCSP response %x, which has expired", staple)
+		}
+	})
+	t.Run("other certificate", func(t *testing.T) {
+		other, _, _ := testCert(t)
+		der := ocspResponse(t, leaf, leaf, key, time.Now().Add(time.Hour))
+		if _, err := NewServer(WithTLS(HTTP("127.0.0.1:0")), WithCertificate(other), WithOCSPStapling(der)); err == nil {
+			t.Errorf("NewServer succeeded with an OCSP response for a certificate it doesn't serve")
+		}
+	})
+}
+
+// issuedCert generates a CA, and a certificate for 127.0.0.1 issued by it, which has ocspURL as its OCSP responder.
+// The returned certificate contains the CA certificate in its chain.
+func issuedCert(t *testing.T, ocspURL string) (tls.Certificate, *x509.Certificate, crypto.Signer) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate the key: %s", err)
+	}
+	caTpl := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, &caTpl, &caTpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("unable to create the CA certificate: %s", err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("unable to parse the CA certificate: %s", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate the key: %s", err)
+	}
+	tpl := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		OCSPServer:   []string{ocspURL},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("unable to create the certificate: %s", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der, caDER}, PrivateKey: key}, ca, caKey
+}
+
+func TestWithOCSPRefresh(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	responses := make(chan []byte, 1)
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			t.Errorf("unable to read the OCSP request: %s", err)
+		}
+		select {
+		case der := <-responses:
+			w.Write(der)
+		default:
+			http.Error(w, "no response", http.StatusServiceUnavailable)
+		}
+	}))
+
+	cert, ca, caKey := issuedCert(t, responder.URL)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("unable to parse the certificate: %s", err)
+	}
+	der := ocspResponse(t, leaf, ca, caKey, time.Now().Add(time.Hour))
+	responses <- der
+
+	ts := startServer(t, WithTLS(HTTP("127.0.0.1:0")), WithCertificate(cert), WithOCSPRefresh(10*time.Millisecond))
+
+	// the response is fetched when the server starts
+	var staple []byte
+	for end := time.Now().Add(testTimeout); time.Now().Before(end) && len(staple) == 0; time.Sleep(10 * time.Millisecond) {
+		staple = handshakeOCSP(t, ts.addrs[0])
+	}
+	if !bytes.Equal(staple, der) {
+		t.Errorf("the handshake contains the OCSP response %x, expected the one fetched from the responder", staple)
+	}
+	// the refresh goroutine ends with the server
+	if err = ts.stop(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+	responder.Close()
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+}
@@ -0,0 +1,177 @@
+package wrapper
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout is the time a client has to send the PROXY protocol header
+const proxyHeaderTimeout = 10 * time.Second
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// WithProxyProtocol makes the listeners expect the PROXY protocol header, version 1 or 2, sent by load balancers
+// like HAProxy, and use the client address it contains as the remote address of the connection.
+// Connections without the header are rejected.
+// The header is read when the connection is first used, so calling its RemoteAddr method blocks until the client
+// sends it, for at most 10 seconds. This is why the WithConnContext function, which is called before the server
+// hands the connection to a goroutine of its own, should not call RemoteAddr, as it would stall accepting
+// the new connections.
+func WithProxyProtocol() SetFn {
+	return proxyProtocol(true)
+}
+
+// WithOptionalProxyProtocol is like WithProxyProtocol, but connections without the header are accepted
+// with their own remote address.
+func WithOptionalProxyProtocol() SetFn {
+	return proxyProtocol(false)
+}
+
+func proxyProtocol(required bool) SetFn {
+	return func(c *c) error {
+		c.wrapListener = append(c.wrapListener, func(l net.Listener) net.Listener {
+			return &proxyListener{Listener: l, required: required}
+		})
+		return nil
+	}
+}
+
+type proxyListener struct {
+	net.Listener
+	required bool
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn), required: l.required}, nil
+}
+
+// proxyConn reads the PROXY protocol header when the connection is first used,
+// so a slow client doesn't block accepting new connections.
+type proxyConn struct {
+	net.Conn
+	r        *bufio.Reader
+	required bool
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.r, c.required)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader consumes the PROXY protocol header from r, returning the source address it contains,
+// or nil if the header doesn't contain one.
+func readProxyHeader(r *bufio.Reader, required bool) (net.Addr, error) {
+	if b, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(b, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if b, err := r.Peek(len(proxyV1Prefix)); err == nil && bytes.Equal(b, proxyV1Prefix) {
+		return readProxyV1(r)
+	}
+	if required {
+		return nil, fmt.Errorf("missing PROXY protocol header")
+	}
+	return nil, nil
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// the maximum length of a version 1 header is 107 bytes, including the CRLF
+	line := make([]byte, 0, 107)
+	for len(line) < cap(line) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY protocol header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("invalid PROXY protocol header: missing CRLF")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol source address %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol header: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("invalid PROXY protocol version %d", header[12]>>4)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol header: %w", err)
+	}
+	if header[12]&0xf == 0 {
+		// LOCAL command, the connection was made by the proxy itself
+		return nil, nil
+	}
+	switch header[13] {
+	case 0x11:
+		// TCP over IPv4
+		if len(data) < 12 {
+			return nil, fmt.Errorf("invalid PROXY protocol IPv4 address length %d", len(data))
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:4]), Port: int(binary.BigEndian.Uint16(data[8:10]))}, nil
+	case 0x21:
+		// TCP over IPv6
+		if len(data) < 36 {
+			return nil, fmt.Errorf("invalid PROXY protocol IPv6 address length %d", len(data))
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:16]), Port: int(binary.BigEndian.Uint16(data[32:34]))}, nil
+	}
+	// unsupported address families are accepted, but we can't use their address
+	return nil, nil
+}
@@ -0,0 +1,97 @@
+package wrapper
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// remoteAddr is a handler responding with the remote address of the request
+var remoteAddr = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, r.RemoteAddr)
+})
+
+// proxyRequest sends a request to addr, preceded by header, and returns the status and the body of the response
+func proxyRequest(t *testing.T, addr string, header []byte) (int, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unable to connect: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(testTimeout))
+
+	req := append(append([]byte{}, header...), "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"...)
+	if _, err = conn.Write(req); err != nil {
+		t.Fatalf("unable to send the request: %s", err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("unable to read the response: %s", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("unable to read the response: %s", err)
+	}
+	return res.StatusCode, string(body)
+}
+
+// proxyV2Header returns a version 2 PROXY header for a TCP over IPv4 connection from src
+func proxyV2Header(src *net.TCPAddr) []byte {
+	h := append([]byte{}, proxyV2Signature...)
+	// version 2, PROXY command, TCP over IPv4, 12 bytes of addresses
+	h = append(h, 0x21, 0x11, 0, 12)
+	h = append(h, src.IP.To4()...)
+	h = append(h, 10, 0, 0, 1)
+	h = binary.BigEndian.AppendUint16(h, uint16(src.Port))
+	return binary.BigEndian.AppendUint16(h, 443)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4321}
+	headers := map[string][]byte{
+		"v1": []byte("PROXY TCP4 192.0.2.1 10.0.0.1 4321 443\r\n"),
+		"v2": proxyV2Header(src),
+	}
+	ts := startServer(t, HTTP("127.0.0.1:0"), WithProxyProtocol(), Handler(remoteAddr))
+	for name, header := range headers {
+		t.Run(name, func(t *testing.T) {
+			if _, body := proxyRequest(t, ts.addrs[0].String(), header); body != src.String() {
+				t.Errorf("the handler received the remote address %s, expected %s", body, src)
+			}
+		})
+	}
+	t.Run("slow client", func(t *testing.T) {
+		// a connection which hasn't sent its header doesn't block accepting the others
+		slow, err := net.Dial("tcp", ts.addrs[0].String())
+		if err != nil {
+			t.Fatalf("unable to connect: %s", err)
+		}
+		defer slow.Close()
+		if _, body := proxyRequest(t, ts.addrs[0].String(), headers["v1"]); body != src.String() {
+			t.Errorf("the handler received the remote address %s, expected %s", body, src)
+		}
+	})
+	t.Run("missing header", func(t *testing.T) {
+		if status, body := proxyRequest(t, ts.addrs[0].String(), nil); status != http.StatusBadRequest {
+			t.Errorf("the request without the header returned %d %q, expected it rejected", status, body)
+		}
+	})
+}
+
+func TestOptionalProxyProtocol(t *testing.T) {
+	ts := startServer(t, HTTP("127.0.0.1:0"), WithOptionalProxyProtocol(), Handler(remoteAddr))
+
+	if _, body := proxyRequest(t, ts.addrs[0].String(), []byte("PROXY TCP4 192.0.2.1 10.0.0.1 4321 443\r\n")); body != "192.0.2.1:4321" {
+		t.Errorf("the handler received the remote address %s, expected 192.0.2.1:4321", body)
+	}
+	_, body := proxyRequest(t, ts.addrs[0].String(), nil)
+	if host, _, _ := net.SplitHostPort(body); host != "127.0.0.1" {
+		t.Errorf("the handler received the remote address %s, expected the connection's own", body)
+	}
+}
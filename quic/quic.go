@@ -0,0 +1,93 @@
+// Package quic serves HTTP/3 together with a wrapper HTTP server.
+// It's a module of its own, so the programs that don't serve HTTP/3 don't depend on quic-go.
+package quic
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"git.sr.ht/~mariusor/wrapper"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// OnQUIC serves HTTP/3 on the UDP address addr, with the same handler as the other listeners.
+// The responses served on the TCP listeners advertise it through the Alt-Svc header.
+// It requires a certificate, set up with HTTPS, WithCertificate or any of the other TLS SetFns.
+func OnQUIC(addr string) wrapper.SetFn {
+	if addr == "" {
+		addr = ":https"
+	}
+	return wrapper.WithService(&service{addr: addr})
+}
+
+// service serves HTTP/3 on a UDP connection
+type service struct {
+	addr string
+	pc   net.PacketConn
+	h3   *http3.Server
+
+	once sync.Once
+	err  error
+}
+
+// Init listens on the UDP address, and makes the server's handler advertise HTTP/3
+func (s *service) Init(srv *http.Server, cfg *tls.Config) error {
+	if cfg == nil {
+		return fmt.Errorf("serving HTTP/3 requires a certificate")
+	}
+	pc, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.pc = pc
+	s.h3 = &http3.Server{
+		Handler:        srv.Handler,
+		TLSConfig:      http3.ConfigureTLSConfig(cfg),
+		MaxHeaderBytes: srv.MaxHeaderBytes,
+	}
+	next := srv.Handler
+	if next == nil {
+		next = http.DefaultServeMux
+	}
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the error means that the HTTP/3 server is not serving yet, so there's nothing to advertise
+		_ = s.h3.SetQuicHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+	return nil
+}
+
+func (s *service) Serve() error {
+	err := s.h3.Serve(s.pc)
+	if errors.Is(err, http.ErrServerClosed) || errors.Is(err, quic.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close closes the HTTP/3 server, and the UDP connection, which quic-go doesn't close as it didn't create it
+func (s *service) Close() error {
+	s.once.Do(func() {
+		if s.h3 != nil {
+			s.err = s.h3.Close()
+		}
+		if s.pc != nil {
+			if err := s.pc.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+				s.err = errors.Join(s.err, err)
+			}
+		}
+	})
+	return s.err
+}
+
+func (s *service) Addr() net.Addr {
+	if s.pc == nil {
+		return nil
+	}
+	return s.pc.LocalAddr()
+}
@@ -0,0 +1,71 @@
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~mariusor/wrapper"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestOnQUIC(t *testing.T) {
+	var addrs []net.Addr
+	s, err := wrapper.NewServer(wrapper.WithTLS(wrapper.HTTP("127.0.0.1:0")), OnQUIC("127.0.0.1:0"), wrapper.WithSelfSignedCert(),
+		wrapper.WithReadyCallback(func(a []net.Addr) {
+			addrs = a
+		}),
+		wrapper.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Proto)
+		})))
+	if err != nil {
+		t.Fatalf("unable to create the server: %s", err)
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	h3 := &http3.RoundTripper{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer h3.Close()
+	res, err := (&http.Client{Transport: h3, Timeout: 5 * time.Second}).Get("https://" + addrs[1].String())
+	if err != nil {
+		t.Fatalf("the HTTP/3 request failed: %s", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "HTTP/3.0" {
+		t.Errorf("the request has been served over %s, expected HTTP/3.0", body)
+	}
+
+	tcp := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	if res, err = tcp.Get("https://" + addrs[0].String()); err != nil {
+		t.Fatalf("the TLS request failed: %s", err)
+	}
+	res.Body.Close()
+	if alt := res.Header.Get("Alt-Svc"); !strings.Contains(alt, "h3=") {
+		t.Errorf("the TLS response advertises %q, expected HTTP/3", alt)
+	}
+
+	cancelFn()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("Run returned %v, expected no error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run didn't return after the context has been canceled")
+	}
+}
+
+func TestOnQUICWithoutCertificate(t *testing.T) {
+	if _, err := wrapper.NewServer(OnQUIC("127.0.0.1:0")); err == nil {
+		t.Errorf("NewServer succeeded serving HTTP/3 without a certificate")
+	}
+}
@@ -0,0 +1,86 @@
+package wrapper
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitTTL is the time after which the limiter of a client that didn't send any requests is removed
+const rateLimitTTL = 10 * time.Minute
+
+// WithRateLimit limits the requests of every client IP address to r per second, with bursts of up to burst requests.
+// The requests over the limit get a 429 Too Many Requests response, with a Retry-After header.
+// When WithTrustedProxies is used, the client address is the one forwarded by the proxies.
+func WithRateLimit(r rate.Limit, burst int) SetFn {
+	return func(c *c) error {
+		if r <= 0 || burst <= 0 {
+			return fmt.Errorf("invalid rate limit %v with burst %d", r, burst)
+		}
+		c.wrap = append(c.wrap, rateLimit(&limiters{r: r, burst: burst, l: make(map[string]*clientLimiter)}))
+		return nil
+	}
+}
+
+type clientLimiter struct {
+	*rate.Limiter
+	seen time.Time
+}
+
+// limiters keeps a rate limiter for every client, removing the ones that haven't been used for rateLimitTTL
+type limiters struct {
+	r     rate.Limit
+	burst int
+
+	m     sync.Mutex
+	l     map[string]*clientLimiter
+	swept time.Time
+}
+
+func (ls *limiters) get(ip string) *rate.Limiter {
+	ls.m.Lock()
+	defer ls.m.Unlock()
+
+	now := time.Now()
+	if now.Sub(ls.swept) > rateLimitTTL {
+		for k, l := range ls.l {
+			if now.Sub(l.seen) > rateLimitTTL {
+				delete(ls.l, k)
+			}
+		}
+		ls.swept = now
+	}
+	l, ok := ls.l[ip]
+	if !ok {
+		l = &clientLimiter{Limiter: rate.NewLimiter(ls.r, ls.burst)}
+		ls.l[ip] = l
+	}
+	l.seen = now
+	return l.Limiter
+}
+
+func rateLimit(ls *limiters) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				ip = r.RemoteAddr
+			}
+			res := ls.get(ip).Reserve()
+			if d := res.Delay(); d > 0 {
+				// the request is not served, so it shouldn't count against the limit
+				res.Cancel()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package wrapper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWithRateLimit(t *testing.T) {
+	h := configure(t, Handler(hello), WithRateLimit(1, 2), WithTrustedProxies([]string{"10.0.0.0/8"})).s.Handler
+	request := func(remote, forwarded string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remote
+		if forwarded != "" {
+			r.Header.Set("X-Forwarded-For", forwarded)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := request("192.0.2.1:1234", ""); w.Code != http.StatusOK {
+			t.Fatalf("the request %d in the burst responded with %d, expected %d", i, w.Code, http.StatusOK)
+		}
+	}
+	w := request("192.0.2.1:1234", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("the request over the limit responded with %d, expected %d", w.Code, http.StatusTooManyRequests)
+	}
+	if ra := w.Header().Get("Retry-After"); ra != "1" {
+		t.Errorf("the response has Retry-After %q, expected 1", ra)
+	}
+	// the other clients have limits of their own
+	if w = request("192.0.2.2:1234", ""); w.Code != http.StatusOK {
+		t.Errorf("another client responded with %d, expected %d", w.Code, http.StatusOK)
+	}
+
+	// the clients behind the trusted proxy are limited by their forwarded address
+	for i := 0; i < 2; i++ {
+		request("10.0.0.1:1234", "203.0.113.1")
+	}
+	if w = request("10.0.0.1:1234", "203.0.113.1"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("the forwarded client over the limit responded with %d, expected %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w = request("10.0.0.1:1234", "203.0.113.2"); w.Code != http.StatusOK {
+		t.Errorf("another client behind the proxy responded with %d, expected %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestRateLimitEviction(t *testing.T) {
+	ls := &limiters{r: 1, burst: 1, l: make(map[string]*clientLimiter)}
+	ls.get("192.0.2.1")
+	ls.get("192.0.2.2")
+
+	// the first client has been idle for longer than the TTL, the second one sends a request now
+	past := time.Now().Add(-2 * rateLimitTTL)
+	ls.l["192.0.2.1"].seen = past
+	ls.swept = past
+	ls.get("192.0.2.2")
+	if _, ok := ls.l["192.0.2.1"]; ok {
+		t.Errorf("the limiter of the idle client has not been removed")
+	}
+	if _, ok := ls.l["192.0.2.2"]; !ok {
+		t.Errorf("the limiter of the active client has been removed")
+	}
+}
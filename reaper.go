@@ -0,0 +1,50 @@
+//go:build unix
+
+package wrapper
+
+import (
+	"context"
+	"os"
+	"syscall"
+)
+
+// WaitStatus is the exit status of a child process collected by WithChildReaper
+type WaitStatus = syscall.WaitStatus
+
+// WithChildReaper collects the exited child processes when receiving SIGCHLD, so they don't become zombies,
+// and calls fn, if not nil, with the PID and exit status of each of them.
+// If there's a handler for SIGCHLD, it gets executed before collecting the children.
+// All the exited children are collected, so the processes started with os/exec should not be waited for,
+// as Wait returns an error if the process has already been collected.
+func WithChildReaper(fn func(pid int, status WaitStatus)) OptionFn {
+	return func(w *w) {
+		next := w.h[syscall.SIGCHLD]
+		w.h[syscall.SIGCHLD] = func(ctx context.Context, sig os.Signal, status chan int) error {
+			if next != nil {
+				if err := next(ctx, sig, status); err != nil {
+					return err
+				}
+			}
+			reapChildren(fn)
+			return nil
+		}
+	}
+}
+
+// reapChildren collects all the exited children, as multiple SIGCHLD signals can be coalesced into one
+func reapChildren(fn func(int, syscall.WaitStatus)) {
+	for {
+		var ws syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			// ECHILD means there are no children left, and a zero PID that the remaining ones are still running
+			return
+		}
+		if fn != nil {
+			fn(pid, ws)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package wrapper
+
+// WaitStatus is the exit status of a child process, which is not available on this platform
+type WaitStatus struct{}
+
+// WithChildReaper does nothing, as there's no SIGCHLD on this platform
+func WithChildReaper(fn func(pid int, status WaitStatus)) OptionFn {
+	return func(*w) {}
+}
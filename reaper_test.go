@@ -0,0 +1,65 @@
+//go:build unix
+
+package wrapper
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWithChildReaper(t *testing.T) {
+	handled := make(chan struct{}, 1)
+	// other tests might have left children behind, so all of them are reported
+	type child struct {
+		pid    int
+		status syscall.WaitStatus
+	}
+	reaped := make(chan child, 16)
+	cmd := exec.Command("/bin/sh", "-c", "exit 3")
+
+	ww := RegisterSignalHandlers(SignalHandlers{
+		syscall.SIGCHLD: func(chan int) {
+			select {
+			case handled <- struct{}{}:
+			default:
+			}
+		},
+	}, WithChildReaper(func(pid int, status syscall.WaitStatus) {
+		select {
+		case reaped <- child{pid: pid, status: status}:
+		default:
+		}
+	}))
+	ctx, cancelFn := context.WithCancel(context.Background())
+	done := execAsync(ww, ctx, waitCtx)
+	defer func() {
+		cancelFn()
+		result(t, done)
+	}()
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("unable to start the child process: %s", err)
+	}
+	for ch := (child{}); ch.pid != cmd.Process.Pid; {
+		select {
+		case ch = <-reaped:
+		case <-time.After(testTimeout):
+			t.Fatalf("the child process has not been reaped in %s", testTimeout)
+		}
+		if ch.pid == cmd.Process.Pid && (!ch.status.Exited() || ch.status.ExitStatus() != 3) {
+			t.Errorf("the child exited with %v, expected exit status 3", ch.status)
+		}
+	}
+	select {
+	case <-handled:
+	default:
+		t.Errorf("the SIGCHLD handler has not been executed")
+	}
+	// the child is gone, so it can't be waited for anymore
+	if err := cmd.Wait(); err == nil {
+		t.Errorf("waiting for the reaped child succeeded")
+	}
+}
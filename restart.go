@@ -0,0 +1,84 @@
+//go:build unix
+
+package wrapper
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Restart starts a new copy of the running binary, with the same arguments, which inherits the server's
+// listeners as if they were passed by systemd socket activation, so it can get them using Socket or SocketNamed.
+// The names of the sockets are their addresses, with the colons replaced by underscores.
+// After it returns successfully, the server should be stopped, and the new process accepts the connections
+// while the old one drains the connections in progress. It's meant to be called from a SIGHUP handler:
+//
+//	syscall.SIGHUP: func(exit chan int) {
+//		if err := srv.Restart(); err == nil {
+//			exit <- 0
+//		}
+//	}
+//
+// LISTEN_PID is not set for the new process, as its PID is not known before starting it.
+// Only the listeners of the main server are inherited, so Restart returns an error when the server
+// also has listeners with their own handlers, like OnAdmin, WithHTTPRedirect or OnUDP, or services added with WithService,
+// like HTTP/3, as the new process couldn't tell them apart.
+func (s *Server) Restart() error {
+	if len(s.c.aux) > 0 || len(s.c.udp) > 0 || len(s.c.services) > 0 {
+		return fmt.Errorf("unable to restart a server with auxiliary listeners, UDP connections or services")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find the executable: %w", err)
+	}
+	files := make([]*os.File, 0, len(s.c.raw))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	names := make([]string, 0, len(s.c.raw))
+	for _, l := range s.c.raw {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("unable to get the file descriptor of listener %s", l.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("unable to get the file descriptor of listener %s: %w", l.Addr(), err)
+		}
+		files = append(files, f)
+		names = append(names, strings.ReplaceAll(l.Addr().String(), ":", "_"))
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(restartEnv(), "LISTEN_FDS="+strconv.Itoa(len(files)), "LISTEN_FDNAMES="+strings.Join(names, ":"))
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("unable to start %s: %w", exe, err)
+	}
+	// the socket files are in use by the new process, so they must not be removed when the listeners get closed
+	for _, l := range s.c.raw {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return cmd.Process.Release()
+}
+
+// restartEnv returns the environment of the current process, without the socket activation variables
+func restartEnv() []string {
+	env := make([]string, 0)
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, "LISTEN_PID=") || strings.HasPrefix(e, "LISTEN_FDS=") || strings.HasPrefix(e, "LISTEN_FDNAMES=") {
+			continue
+		}
+		env = append(env, e)
+	}
+	return env
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package wrapper
+
+import "fmt"
+
+// Restart returns an error, as passing the listeners to a new process is not supported on this platform
+func (s *Server) Restart() error {
+	return fmt.Errorf("restarting the server is not supported on this platform")
+}
@@ -0,0 +1,64 @@
+//go:build unix
+
+package wrapper
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestart(t *testing.T) {
+	if isChild(t) {
+		serveOnce(t, Socket())
+		return
+	}
+	started, finished, stopping := make(chan struct{}, 1), make(chan struct{}, 1), make(chan struct{})
+	ts := startServer(t, HTTP("127.0.0.1:0"), GracefulWait(time.Second),
+		WithRegisterOnShutdown(func() { close(stopping) }),
+		Handler(draining(started, finished, 200*time.Millisecond)))
+	inFlight := getAsync(t, ts.url("http", 0))
+	<-started
+
+	// the new process runs only this test, with its output captured, and inherits childEnv through the environment
+	out, err := os.CreateTemp(t.TempDir(), "child")
+	if err != nil {
+		t.Fatalf("unable to create the output file: %s", err)
+	}
+	defer out.Close()
+	t.Setenv(childEnv, t.Name())
+	args, stdout, stderr := os.Args, os.Stdout, os.Stderr
+	os.Args = []string{args[0], "-test.run=^" + t.Name() + "$", "-test.timeout=" + testTimeout.String()}
+	os.Stdout, os.Stderr = out, out
+	err = ts.Restart()
+	os.Args, os.Stdout, os.Stderr = args, stdout, stderr
+	if err != nil {
+		t.Fatalf("Restart returned %v, expected no error", err)
+	}
+
+	ts.cancelFn()
+	<-stopping
+	// the listener of the old process is closed, so the request is accepted by the new one
+	if body := get(t, http.DefaultClient, ts.url("http", 0)); body != "1" {
+		t.Errorf("the new process has %s listeners, expected 1", body)
+	}
+	if body := <-inFlight; body != "<nil>" {
+		t.Errorf("the request in progress received %q, expected it to complete", body)
+	}
+	if err = ts.wait(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+	if t.Failed() {
+		b, _ := os.ReadFile(out.Name())
+		t.Logf("the output of the new process:\n%s", b)
+	}
+}
+
+func TestRestartAuxListeners(t *testing.T) {
+	ts := startServer(t, HTTP("127.0.0.1:0"), OnAdmin("127.0.0.1:0", hello), Handler(hello))
+	if err := ts.Restart(); err == nil || !strings.Contains(err.Error(), "auxiliary listeners") {
+		t.Errorf("Restart returned %v for a server with an admin listener, expected an error", err)
+	}
+}
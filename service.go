@@ -0,0 +1,73 @@
+package wrapper
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// Service is a server for another protocol than HTTP over TCP, like HTTP/3, which shares the lifecycle
+// of the HTTP server. It gets added to the server with WithService.
+type Service interface {
+	// Init is called once the HTTP server has been configured, with its TLS configuration, which has the certificates
+	// loaded, or nil if the server has none. It can replace the server's handler, for wrapping it.
+	Init(s *http.Server, cfg *tls.Config) error
+	// Serve blocks until Close gets called, when it returns nil
+	Serve() error
+	// Close stops serving, closing the connections in progress.
+	// It can be called more than once, and without Init or Serve having been called.
+	Close() error
+	// Addr returns the address the service listens on
+	Addr() net.Addr
+}
+
+// WithService runs s together with the HTTP server: it gets started and stopped at the same time as the listeners.
+// As a Service has no graceful shutdown, it gets closed after the HTTP server has drained its connections.
+func WithService(s Service) SetFn {
+	return func(c *c) error {
+		if s == nil {
+			return errors.New("invalid nil service")
+		}
+		c.services = append(c.services, s)
+		return nil
+	}
+}
+
+// initServices passes the server to the services, which happens after the server's handler has been wrapped
+func (c *c) initServices() error {
+	if len(c.services) == 0 {
+		return nil
+	}
+	var cfg *tls.Config
+	if c.useTLS() {
+		var err error
+		if cfg, err = c.tlsConfig(); err != nil {
+			return err
+		}
+	}
+	for _, s := range c.services {
+		if err := s.Init(c.s, cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *c) serveService(s Service) error {
+	if err := s.Serve(); err != nil {
+		return ListenerError{Addr: s.Addr(), Err: err}
+	}
+	return nil
+}
+
+// closeServices closes all the services, which don't support graceful shutdown
+func (c *c) closeServices() error {
+	var err error
+	for _, s := range c.services {
+		if e := s.Close(); e != nil {
+			err = errors.Join(err, e)
+		}
+	}
+	return err
+}
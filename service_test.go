@@ -0,0 +1,98 @@
+package wrapper
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testService records the calls to its methods, and serves until it's closed
+type testService struct {
+	cfg    *tls.Config
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newTestService() *testService {
+	return &testService{closed: make(chan struct{})}
+}
+
+func (s *testService) Init(srv *http.Server, cfg *tls.Config) error {
+	s.cfg = cfg
+	next := srv.Handler
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Service", "test")
+		next.ServeHTTP(w, r)
+	})
+	return nil
+}
+
+func (s *testService) Serve() error {
+	<-s.closed
+	return nil
+}
+
+func (s *testService) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+func (s *testService) Addr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}
+}
+
+func TestWithService(t *testing.T) {
+	svc := newTestService()
+	ts := startServer(t, HTTP("127.0.0.1:0"), WithService(svc), Handler(hello))
+	if svc.cfg != nil {
+		t.Errorf("the service received a TLS configuration for a server without certificates")
+	}
+	if len(ts.addrs) != 2 || ts.addrs[1].String() != svc.Addr().String() {
+		t.Errorf("the ready callback received %v, expected the address of the service too", ts.addrs)
+	}
+	res, err := http.Get(ts.url("http", 0))
+	if err != nil {
+		t.Fatalf("the request failed: %s", err)
+	}
+	res.Body.Close()
+	if res.Header.Get("X-Service") != "test" {
+		t.Errorf("the handler has not been wrapped by the service")
+	}
+	if err = ts.stop(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+}
+
+func TestWithServiceCertFiles(t *testing.T) {
+	svc := newTestService()
+	cert, key := testCertFiles(t)
+	startServer(t, HTTPS("127.0.0.1:0", cert, key), WithService(svc))
+	if svc.cfg == nil || len(svc.cfg.Certificates) != 1 {
+		t.Fatalf("the service didn't receive the certificate passed to HTTPS")
+	}
+}
+
+func TestServiceClosedOnShutdownError(t *testing.T) {
+	svc := newTestService()
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	ts := startServer(t, HTTP("127.0.0.1:0"), WithService(svc), GracefulWait(50*time.Millisecond),
+		Handler(stuck(started, release)))
+
+	go http.Get(ts.url("http", 0))
+	<-started
+	if err := ts.stop(t); !errors.As(err, &ShutdownError{}) {
+		t.Errorf("Run returned %v, expected a ShutdownError", err)
+	}
+	select {
+	case <-svc.closed:
+	default:
+		t.Errorf("the service has not been closed")
+	}
+}
@@ -0,0 +1,185 @@
+package wrapper
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sdListenFdsStart is the first file descriptor passed by systemd socket activation
+const sdListenFdsStart = 3
+
+var sdListen struct {
+	once  sync.Once
+	fds   []uintptr
+	names []string
+	err   error
+}
+
+// systemdFds returns the file descriptors passed by systemd socket activation and their names, if present.
+// The number of sockets is read from the LISTEN_FDS environment variable.
+// Like sd_listen_fds, no file descriptors are returned if LISTEN_FDS is missing, or if LISTEN_PID is set
+// to a different process, and the environment variables are unset so they don't get inherited by child
+// processes, which is why they are read only once. A missing LISTEN_PID is accepted, as Restart can't set it.
+func systemdFds() ([]uintptr, []string, error) {
+	sdListen.once.Do(func() {
+		defer unsetSystemdEnv()
+		if pid, ok := os.LookupEnv("LISTEN_PID"); ok && pid != strconv.Itoa(os.Getpid()) {
+			return
+		}
+		fds, ok := os.LookupEnv("LISTEN_FDS")
+		if !ok {
+			// the file descriptors have not been passed by systemd, so they're not ours to take over
+			return
+		}
+		nfds, err := strconv.Atoi(fds)
+		if err != nil || nfds < 0 {
+			sdListen.err = fmt.Errorf("invalid LISTEN_FDS value %q", fds)
+			return
+		}
+		for fd := uintptr(sdListenFdsStart); fd < sdListenFdsStart+uintptr(nfds); fd++ {
+			sdListen.fds = append(sdListen.fds, fd)
+		}
+		if names := os.Getenv("LISTEN_FDNAMES"); names != "" {
+			sdListen.names = strings.Split(names, ":")
+		}
+	})
+	return sdListen.fds, sdListen.names, sdListen.err
+}
+
+func unsetSystemdEnv() {
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+}
+
+// OnFd listens on the socket with the file descriptor fd, which has been bound by another process,
+// like inetd, or the parent process. The fd must be a listening stream socket.
+// It gets closed once the listener has been created, as the listener uses a duplicate of it,
+// otherwise it's left open.
+func OnFd(fd uintptr, name string) SetFn {
+	return func(c *c) error {
+		l, err := fdListener(fd, name)
+		if err != nil {
+			return err
+		}
+		c.l = append(c.l, l)
+		return nil
+	}
+}
+
+// Socket uses the sockets passed by systemd socket activation.
+func Socket() SetFn {
+	return func(c *c) error {
+		fds, _, err := systemdFds()
+		if err != nil {
+			return err
+		}
+		for _, fd := range fds {
+			l, err := fdListener(fd, "from systemd")
+			if err != nil {
+				return err
+			}
+			c.l = append(c.l, l)
+		}
+		return nil
+	}
+}
+
+// SocketNamed uses the sockets passed by systemd socket activation which have been named name,
+// using the FileDescriptorName= option in the socket unit.
+// If systemd didn't pass any names, it behaves like Socket.
+func SocketNamed(name string) SetFn {
+	return func(c *c) error {
+		fds, names, err := systemdFds()
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			return Socket()(c)
+		}
+		found := false
+		for i, fd := range fds {
+			if i >= len(names) || names[i] != name {
+				continue
+			}
+			l, err := fdListener(fd, name)
+			if err != nil {
+				return err
+			}
+			c.l = append(c.l, l)
+			found = true
+		}
+		if !found {
+			return fmt.Errorf("no socket named %q has been passed by systemd", name)
+		}
+		return nil
+	}
+}
+
+// SystemdNotify sends state to the systemd service manager, see sd_notify(3) for the possible values.
+// It does nothing if the NOTIFY_SOCKET environment variable is not set.
+func SystemdNotify(state string) error {
+	sock := os.Getenv("NOTIFY_SOCKET")
+	if sock == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("unable to connect to systemd notify socket %q: %w", sock, err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("unable to notify systemd: %w", err)
+	}
+	return nil
+}
+
+// WithSystemdNotify makes the server notify systemd when it's ready to serve requests and when it's stopping,
+// for services with Type=notify.
+func WithSystemdNotify() SetFn {
+	return func(c *c) error {
+		c.notify = true
+		return nil
+	}
+}
+
+// WithSystemdWatchdog makes the server send keep-alive pings to systemd for units with WatchdogSec= set,
+// at half the interval systemd expects them. It does nothing if the WATCHDOG_USEC environment variable
+// is not set, or if WATCHDOG_PID is set to a different process.
+func WithSystemdWatchdog() SetFn {
+	return func(c *c) error {
+		if pid, ok := os.LookupEnv("WATCHDOG_PID"); ok && pid != strconv.Itoa(os.Getpid()) {
+			return nil
+		}
+		usec, ok := os.LookupEnv("WATCHDOG_USEC")
+		if !ok {
+			return nil
+		}
+		n, err := strconv.ParseInt(usec, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid WATCHDOG_USEC value %q", usec)
+		}
+		c.watchdog = time.Duration(n) * time.Microsecond / 2
+		return nil
+	}
+}
+
+// pingWatchdog notifies systemd every interval, until done is closed
+func pingWatchdog(interval time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			_ = SystemdNotify("WATCHDOG=1")
+		}
+	}
+}
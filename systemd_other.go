@@ -0,0 +1,12 @@
+//go:build !unix
+
+package wrapper
+
+import (
+	"fmt"
+	"net"
+)
+
+func fdListener(fd uintptr, _ string) (net.Listener, error) {
+	return nil, fmt.Errorf("unable to use file descriptor %d as listener: not supported on this platform", fd)
+}
@@ -0,0 +1,66 @@
+package wrapper
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// resetSystemdFds makes systemdFds read the environment again, during the test and after it
+func resetSystemdFds(t *testing.T) {
+	reset := func() {
+		sdListen.once = sync.Once{}
+		sdListen.fds = nil
+		sdListen.names = nil
+		sdListen.err = nil
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestSystemdFds(t *testing.T) {
+	resetSystemdFds(t)
+	t.Setenv("LISTEN_FDS", "2")
+
+	fds, _, err := systemdFds()
+	if err != nil {
+		t.Fatalf("systemdFds returned %v, expected no error", err)
+	}
+	if expected := []uintptr{3, 4}; !reflect.DeepEqual(fds, expected) {
+		t.Errorf("systemdFds returned %v, expected %v", fds, expected)
+	}
+	if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+		t.Errorf("LISTEN_FDS has not been unset")
+	}
+}
+
+func TestSystemdFdsOtherPID(t *testing.T) {
+	resetSystemdFds(t)
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+
+	fds, _, err := systemdFds()
+	if err != nil || len(fds) > 0 {
+		t.Errorf("systemdFds returned %v, %v, expected no file descriptors", fds, err)
+	}
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, ok := os.LookupEnv(name); ok {
+			t.Errorf("%s has not been unset", name)
+		}
+	}
+	if _, err = NewServer(Socket()); err == nil {
+		t.Errorf("NewServer succeeded with the sockets of another process")
+	}
+}
+
+func TestSocketNamedMissing(t *testing.T) {
+	resetSystemdFds(t)
+	t.Setenv("LISTEN_FDS", "2")
+	t.Setenv("LISTEN_FDNAMES", "http:metrics")
+
+	if _, err := NewServer(SocketNamed("admin")); err == nil {
+		t.Errorf("NewServer succeeded with a socket name that has not been passed")
+	}
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package wrapper
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// fdListener returns a listener for the socket fd, which gets closed only if the listener has been created
+func fdListener(fd uintptr, name string) (net.Listener, error) {
+	// the listener is created from a duplicate, so fd is left alone if it's not a socket we can listen on
+	syscall.ForkLock.RLock()
+	dup, err := syscall.Dup(int(fd))
+	if err == nil {
+		syscall.CloseOnExec(dup)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("unable to use file descriptor %d as listener: %w", fd, err)
+	}
+	f := os.NewFile(uintptr(dup), name)
+	l, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("unable to use file descriptor %d as listener: %w", fd, err)
+	}
+	syscall.Close(int(fd))
+	return l, nil
+}
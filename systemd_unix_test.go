@@ -0,0 +1,296 @@
+//go:build unix
+
+package wrapper
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// childEnv is the environment variable that makes a test run as the child process started by startChild
+const childEnv = "WRAPPER_TEST_CHILD"
+
+// isChild returns true if the test is running in the child process started by startChild
+func isChild(t *testing.T) bool {
+	return os.Getenv(childEnv) == t.Name()
+}
+
+// child is a test running again in a child process
+type child struct {
+	cmd *exec.Cmd
+	out bytes.Buffer
+}
+
+// startChild runs the test again in a child process, which receives files starting with the file descriptor 3,
+// and has env added to its environment
+func startChild(t *testing.T, files []*os.File, env ...string) *child {
+	t.Helper()
+	ch := &child{cmd: exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")}
+	ch.cmd.Env = append(append(os.Environ(), env...), childEnv+"="+t.Name())
+	ch.cmd.ExtraFiles = files
+	ch.cmd.Stdout = &ch.out
+	ch.cmd.Stderr = &ch.out
+	if err := ch.cmd.Start(); err != nil {
+		t.Fatalf("unable to start the child process: %s", err)
+	}
+	t.Cleanup(func() {
+		if ch.cmd.ProcessState == nil {
+			ch.cmd.Process.Kill()
+			ch.cmd.Wait()
+		}
+	})
+	return ch
+}
+
+// wait fails the test if the child process doesn't exit successfully
+func (ch *child) wait(t *testing.T) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		done <- ch.cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("the child process failed: %s\n%s", err, ch.out.String())
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("the child process didn't exit in %s", testTimeout)
+	}
+}
+
+// serveOnce runs in the child process a server configured with fn, which responds to the first request
+// with the number of its listeners, then stops
+func serveOnce(t *testing.T, fn SetFn) {
+	t.Helper()
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+
+	listeners := 0
+	s, err := NewServer(fn, WithReadyCallback(func(addrs []net.Addr) {
+		listeners = len(addrs)
+	}), Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, listeners)
+		cancelFn()
+	})))
+	if err != nil {
+		t.Fatalf("unable to create the server: %s", err)
+	}
+	if err = s.Run(ctx); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+}
+
+// listenerFile returns a TCP listener on an ephemeral port, and its file, which can be passed to a child process
+func listenerFile(t *testing.T) (net.Listener, *os.File) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("unable to get the file of the listener: %s", err)
+	}
+	t.Cleanup(func() {
+		f.Close()
+	})
+	return l, f
+}
+
+func TestSocket(t *testing.T) {
+	if isChild(t) {
+		serveOnce(t, Socket())
+		return
+	}
+	l, f := listenerFile(t)
+	ch := startChild(t, []*os.File{f}, "LISTEN_FDS=1")
+
+	if body := get(t, http.DefaultClient, "http://"+l.Addr().String()); body != "1" {
+		t.Errorf("the server has %s listeners, expected 1", body)
+	}
+	ch.wait(t)
+}
+
+func TestSocketNamed(t *testing.T) {
+	if isChild(t) {
+		serveOnce(t, SocketNamed("http"))
+		return
+	}
+	_, metrics := listenerFile(t)
+	l, f := listenerFile(t)
+	ch := startChild(t, []*os.File{metrics, f}, "LISTEN_FDS=2", "LISTEN_FDNAMES=metrics:http")
+
+	if body := get(t, http.DefaultClient, "http://"+l.Addr().String()); body != "1" {
+		t.Errorf("the server has %s listeners, expected only the one named http", body)
+	}
+	ch.wait(t)
+}
+
+func TestOnFd(t *testing.T) {
+	if isChild(t) {
+		serveOnce(t, OnFd(3, "inherited"))
+		return
+	}
+	l, f := listenerFile(t)
+	ch := startChild(t, []*os.File{f})
+
+	if body := get(t, http.DefaultClient, "http://"+l.Addr().String()); body != "1" {
+		t.Errorf("the server has %s listeners, expected 1", body)
+	}
+	ch.wait(t)
+
+	// a regular file is not accepted as a listener
+	file, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatalf("unable to create the file: %s", err)
+	}
+	defer file.Close()
+	fd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		t.Fatalf("unable to duplicate the file descriptor: %s", err)
+	}
+	if _, err := NewServer(OnFd(uintptr(fd), "file")); err == nil {
+		t.Errorf("NewServer succeeded with the file descriptor of a regular file")
+	}
+	// the file descriptor which has not been used as a listener is left open
+	if err = syscall.Close(fd); err != nil {
+		t.Errorf("the file descriptor of the regular file has been closed: %s", err)
+	}
+}
+
+func TestSocketWithoutSystemd(t *testing.T) {
+	if isChild(t) {
+		if _, err := NewServer(Socket()); err == nil {
+			t.Errorf("NewServer succeeded without LISTEN_FDS")
+		}
+		// the file the parent passed as fd 3 is still usable
+		f := os.NewFile(3, "inherited")
+		defer f.Close()
+		if b, err := io.ReadAll(f); err != nil || string(b) != "content" {
+			t.Errorf("read %q, %v from the inherited file, expected %q", b, err, "content")
+		}
+		return
+	}
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte("content"), 0600); err != nil {
+		t.Fatalf("unable to write the file: %s", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unable to open the file: %s", err)
+	}
+	defer f.Close()
+	startChild(t, []*os.File{f}).wait(t)
+}
+
+// notifySocket is a datagram socket receiving the notifications sent to systemd
+type notifySocket struct {
+	conn *net.UnixConn
+}
+
+// listenNotify listens on a datagram socket, which is set as NOTIFY_SOCKET for the test
+func listenNotify(t *testing.T) *notifySocket {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("unable to listen on the notify socket: %s", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	t.Setenv("NOTIFY_SOCKET", path)
+	return &notifySocket{conn: conn}
+}
+
+// read returns the next message received in d, or false if none has been
+func (n *notifySocket) read(d time.Duration) (string, bool) {
+	buf := make([]byte, 1024)
+	n.conn.SetReadDeadline(time.Now().Add(d))
+	l, err := n.conn.Read(buf)
+	if err != nil {
+		return "", false
+	}
+	return string(buf[:l]), true
+}
+
+// next returns the next message, failing the test if none is received
+func (n *notifySocket) next(t *testing.T) string {
+	t.Helper()
+	msg, ok := n.read(testTimeout)
+	if !ok {
+		t.Fatalf("no message has been received on the notify socket in %s", testTimeout)
+	}
+	return msg
+}
+
+func TestSystemdNotify(t *testing.T) {
+	sock := listenNotify(t)
+
+	ts := startServer(t, HTTP("127.0.0.1:0"), WithSystemdNotify())
+	if msg := sock.next(t); msg != "READY=1" {
+		t.Errorf("received %q, expected READY=1", msg)
+	}
+	if err := ts.stop(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+	if msg := sock.next(t); msg != "STOPPING=1" {
+		t.Errorf("received %q, expected STOPPING=1", msg)
+	}
+
+	if err := SystemdNotify("STATUS=serving"); err != nil {
+		t.Errorf("SystemdNotify returned %v, expected no error", err)
+	}
+	if msg := sock.next(t); msg != "STATUS=serving" {
+		t.Errorf("received %q, expected STATUS=serving", msg)
+	}
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := SystemdNotify("READY=1"); err != nil {
+		t.Errorf("SystemdNotify returned %v without a notify socket, expected no error", err)
+	}
+}
+
+func TestSystemdWatchdog(t *testing.T) {
+	sock := listenNotify(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	ts := startServer(t, HTTP("127.0.0.1:0"), WithSystemdWatchdog())
+	for pings := 0; pings < 2; {
+		if msg := sock.next(t); msg == "WATCHDOG=1" {
+			pings++
+		}
+	}
+	if err := ts.stop(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+	// the pings sent before the server stopped are discarded
+	for {
+		if _, ok := sock.read(50 * time.Millisecond); !ok {
+			break
+		}
+	}
+	if msg, ok := sock.read(100 * time.Millisecond); ok {
+		t.Errorf("received %q after the server stopped", msg)
+	}
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if c := configure(t, WithSystemdWatchdog()); c.watchdog != 0 {
+		t.Errorf("the watchdog has been enabled for another process")
+	}
+}
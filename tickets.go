@@ -0,0 +1,130 @@
+package wrapper
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sessionTicketKeys is the number of keys kept, the current one and the previous ones,
+// which can still decrypt the tickets issued before the last rotations
+const sessionTicketKeys = 3
+
+// WithSessionTicketRotation replaces the TLS session ticket keys every interval, while the server is running,
+// keeping the previous two for resuming the sessions of the tickets they have issued.
+// It applies to the TCP listeners serving TLS, HTTP/3 keeps the automatic rotation of crypto/tls.
+func WithSessionTicketRotation(interval time.Duration) SetFn {
+	return func(c *c) error {
+		if interval <= 0 {
+			return fmt.Errorf("invalid session ticket rotation interval %s", interval)
+		}
+		c.ticketRotation = interval
+		return nil
+	}
+}
+
+// ticketRotator serves the TLS connections with a copy of the server's configuration, with its own session ticket keys.
+// http.Server.ServeTLS uses a clone of the configuration, on which setting the keys after it started has no effect.
+type ticketRotator struct {
+	s *http.Server
+
+	m    sync.Mutex
+	keys [][32]byte
+	cfg  *tls.Config
+}
+
+// initTickets makes the server's TLS configuration get the session ticket keys from a ticketRotator
+func (c *c) initTickets() error {
+	if c.ticketRotation == 0 {
+		return nil
+	}
+	cfg := c.s.TLSConfig
+	if cfg.GetConfigForClient != nil {
+		return fmt.Errorf("session ticket rotation is not supported with GetConfigForClient")
+	}
+	if !hasCertificates(cfg) {
+		// the configuration with the rotated keys is a clone of the server's one, so ServeTLS doesn't load
+		// the certificate passed to HTTPS into it
+		tc, err := c.tlsConfig()
+		if err != nil {
+			return err
+		}
+		cfg.Certificates = tc.Certificates
+	}
+	r := &ticketRotator{s: c.s}
+	if err := r.rotate(); err != nil {
+		return err
+	}
+	c.tickets = r
+	cfg.GetConfigForClient = r.getConfigForClient
+	return nil
+}
+
+// getConfigForClient returns the configuration with the current keys, which is created on the first handshake,
+// after ServeTLS has finished setting up the server's configuration
+func (r *ticketRotator) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.cfg == nil {
+		cfg := r.s.TLSConfig.Clone()
+		cfg.GetConfigForClient = nil
+		// depending on the Go version, ServeTLS adds these to its own clone only
+		if _, ok := r.s.TLSNextProto["h2"]; (r.s.TLSNextProto == nil || ok) && !hasProto(cfg.NextProtos, "h2") {
+			cfg.NextProtos = append(cfg.NextProtos, "h2")
+		}
+		if !hasProto(cfg.NextProtos, "http/1.1") {
+			cfg.NextProtos = append(cfg.NextProtos, "http/1.1")
+		}
+		cfg.SetSessionTicketKeys(r.keys)
+		r.cfg = cfg
+	}
+	return r.cfg, nil
+}
+
+func hasProto(protos []string, p string) bool {
+	for _, proto := range protos {
+		if proto == p {
+			return true
+		}
+	}
+	return false
+}
+
+// rotate generates a new key, which is used for issuing the tickets from then on
+func (r *ticketRotator) rotate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return fmt.Errorf("unable to generate session ticket key: %w", err)
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.keys = append([][32]byte{key}, r.keys...)
+	if len(r.keys) > sessionTicketKeys {
+		r.keys = r.keys[:sessionTicketKeys]
+	}
+	if r.cfg != nil {
+		r.cfg.SetSessionTicketKeys(r.keys)
+	}
+	return nil
+}
+
+// run rotates the keys every interval, until done is closed
+func (r *ticketRotator) run(interval time.Duration, logf func(string, ...interface{}), done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			if err := r.rotate(); err != nil {
+				logf("%s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package wrapper
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// resumed sends a request on a new TLS connection to addr, returning whether the session has been resumed.
+// The response is read, so the client gets the session tickets sent after the handshake.
+func resumed(t *testing.T, addr net.Addr, cfg *tls.Config) bool {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr.String(), cfg)
+	if err != nil {
+		t.Fatalf("the TLS handshake failed: %s", err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET / HTTP/1.0\r\n\r\n")
+	if _, err = io.ReadAll(conn); err != nil {
+		t.Fatalf("unable to read the response: %s", err)
+	}
+	return conn.ConnectionState().DidResume
+}
+
+// ticketKeys returns the current session ticket keys of the server
+func ticketKeys(c *c) [][32]byte {
+	c.tickets.m.Lock()
+	defer c.tickets.m.Unlock()
+	return append([][32]byte{}, c.tickets.keys...)
+}
+
+func TestWithSessionTicketRotation(t *testing.T) {
+	cert, key := testCertFiles(t)
+	ts := startServer(t, HTTPS("127.0.0.1:0", cert, key), WithSessionTicketRotation(time.Hour), Handler(hello))
+	client := &tls.Config{InsecureSkipVerify: true, ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+
+	if resumed(t, ts.addrs[0], client) {
+		t.Errorf("the first connection resumed a session")
+	}
+	if !resumed(t, ts.addrs[0], client) {
+		t.Errorf("the second connection didn't resume the session")
+	}
+	// the tickets issued with the previous keys can still be used
+	ts.c.tickets.rotate()
+	if !resumed(t, ts.addrs[0], client) {
+		t.Errorf("the session has not been resumed after a key rotation")
+	}
+	for i := 0; i < sessionTicketKeys; i++ {
+		ts.c.tickets.rotate()
+	}
+	if resumed(t, ts.addrs[0], client) {
+		t.Errorf("the session has been resumed with a ticket issued with a discarded key")
+	}
+}
+
+func TestSessionTicketRotationStops(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	ts := startServer(t, WithTLS(HTTP("127.0.0.1:0")), WithSelfSignedCert(), WithSessionTicketRotation(10*time.Millisecond))
+	first := ticketKeys(ts.c)[0]
+	for end := time.Now().Add(testTimeout); ; time.Sleep(10 * time.Millisecond) {
+		if keys := ticketKeys(ts.c); len(keys) == sessionTicketKeys && keys[sessionTicketKeys-1] != first {
+			// the keys have been rotated at least sessionTicketKeys times
+			break
+		}
+		if time.Now().After(end) {
+			t.Fatalf("the session ticket keys have not been rotated in %s", testTimeout)
+		}
+	}
+	if err := ts.stop(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+	keys := ticketKeys(ts.c)
+	time.Sleep(50 * time.Millisecond)
+	if ticketKeys(ts.c)[0] != keys[0] {
+		t.Errorf("the session ticket keys have been rotated after the server stopped")
+	}
+}
@@ -0,0 +1,53 @@
+package wrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// udpService is a UDP connection, served by fn
+type udpService struct {
+	pc net.PacketConn
+	fn func(context.Context, net.PacketConn) error
+}
+
+// OnUDP listens on the UDP address addr, and serves it with fn, which shares the lifecycle of the HTTP server.
+// When the server stops, the context fn receives gets canceled and the connection gets closed,
+// so fn returns from reading it. Its error is ignored if it's caused by the connection getting closed.
+func OnUDP(addr string, fn func(context.Context, net.PacketConn) error) SetFn {
+	return func(c *c) error {
+		if fn == nil {
+			return fmt.Errorf("nil UDP handler")
+		}
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+		c.udp = append(c.udp, udpService{pc: pc, fn: fn})
+		return nil
+	}
+}
+
+func (c *c) serveUDP(u udpService) error {
+	if err := u.fn(c.udpCtx, u.pc); err != nil && !errors.Is(err, net.ErrClosed) && c.udpCtx.Err() == nil {
+		return ListenerError{Addr: u.pc.LocalAddr(), Err: err}
+	}
+	return nil
+}
+
+// closeUDP cancels the context of the UDP handlers and closes their connections, making them return
+func (c *c) closeUDP() error {
+	if c.udpCancel != nil {
+		// the handlers find out they need to return before their reads fail
+		c.udpCancel()
+	}
+	var err error
+	for _, u := range c.udp {
+		if e := u.pc.Close(); e != nil && !errors.Is(e, net.ErrClosed) {
+			err = errors.Join(err, e)
+		}
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package wrapper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOnUDP(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	// the handler reports the error it got reading, and the error of its context
+	returned := make(chan [2]error, 1)
+	echo := func(ctx context.Context, pc net.PacketConn) error {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				returned <- [2]error{err, ctx.Err()}
+				return err
+			}
+			if _, err = pc.WriteTo(bytes.ToUpper(buf[:n]), addr); err != nil {
+				return err
+			}
+		}
+	}
+	ts := startServer(t, OnUDP("127.0.0.1:0", echo))
+
+	conn, err := net.Dial("udp", ts.addrs[0].String())
+	if err != nil {
+		t.Fatalf("unable to dial: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("unable to send the packet: %s", err)
+	}
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "PING" {
+		t.Errorf("received %q, %v, expected the handler to respond with %q", buf[:n], err, "PING")
+	}
+
+	if err = ts.stop(t); err != nil {
+		t.Errorf("Run returned %v, expected no error", err)
+	}
+	errs := <-returned
+	if !errors.Is(errs[0], net.ErrClosed) {
+		t.Errorf("the handler failed to read with %v, expected the connection to be closed", errs[0])
+	}
+	if errs[1] == nil {
+		t.Errorf("the context of the handler has not been canceled")
+	}
+}
+
+func TestOnUDPError(t *testing.T) {
+	errFail := errors.New("fail")
+	ts := startServer(t, HTTP("127.0.0.1:0"), OnUDP("127.0.0.1:0", func(context.Context, net.PacketConn) error {
+		return errFail
+	}))
+	err := ts.wait(t)
+	var lerr ListenerError
+	if !errors.As(err, &lerr) || !errors.Is(err, errFail) {
+		t.Fatalf("Run returned %v, expected a ListenerError for %v", err, errFail)
+	}
+	if lerr.Addr.String() != ts.addrs[1].String() {
+		t.Errorf("the error is for %s, expected the UDP address %s", lerr.Addr, ts.addrs[1])
+	}
+}
@@ -1,8 +1,15 @@
 package wrapper
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type (
@@ -11,45 +18,691 @@ type (
 		signal chan os.Signal
 		// status is a channel on which we return the exit codes for application
 		status chan int
+		// err is a channel on which we return errors that end the execution
+		err chan error
+		// m guards the handlers map
+		m sync.Mutex
 		// handlers is the mapping of signals to functions to execute
-		h SignalHandlers
+		h map[os.Signal]sigHandler
+		// panicFn is called when a signal handler panics
+		panicFn func(os.Signal, interface{}) error
+		// stopFn is called once when the execution ends
+		stopFn func(context.Context) error
+		// stopTimeout is the duration stopFn has to finish
+		stopTimeout time.Duration
+		// debounce is the interval in which repeated deliveries of a signal are ignored
+		debounce map[os.Signal]time.Duration
+		// timeout is the duration the handler for a signal has to finish
+		timeout map[os.Signal]time.Duration
+		// fired is the time the handler for a signal has last been executed
+		fired map[os.Signal]time.Time
+		// defaultFn is the handler for the received signals which don't have one of their own
+		defaultFn sigHandler
+		// defaultSigs are the signals received only for defaultFn
+		defaultSigs []os.Signal
+		// observeFn is called for every signal received, before its handler
+		observeFn func(os.Signal)
+		// external is set when the signals are received from a channel set by WithSignalSource instead of the os
+		external bool
+		// restart is the policy for running fn again when it fails
+		restart *RestartPolicy
+		// logFn logs what the wrapper is doing
+		logFn func(string, ...interface{})
+		// cleanErrs are the errors that end the execution as cleanly as an exit status of 0
+		cleanErrs []error
 	}
 
+	// OptionFn is a function that configures the signal wrapper
+	OptionFn func(*w)
+
+	// sigHandler is the form all the signal handler types get adapted to
+	sigHandler func(context.Context, os.Signal, chan int) error
+
 	handlerFn func(chan int)
 
-	// SignalHandlers is a map that stores the association between signals and functions to be executed
+	// handlerExtFn is a signal handler which receives the signal that triggered it
+	handlerExtFn func(os.Signal, chan int)
+
+	// SignalHandlers is a map that stores the association between signals and functions to be executed.
+	// The execution ends only when a handler pushes an exit code, so the handlers for signals which don't
+	// terminate the process, like SIGWINCH or SIGCONT, run every time the signal is received.
 	SignalHandlers map[os.Signal]handlerFn
+
+	// SignalHandlersExt is a map that stores the association between signals and functions to be executed,
+	// the functions receive the signal they have been triggered by, so the same one can be used for multiple signals
+	SignalHandlersExt map[os.Signal]handlerExtFn
+
+	// simpleHandlerFn is a signal handler which ends the execution by returning a non nil error
+	simpleHandlerFn func(context.Context) error
+
+	// SimpleHandlers is a map that stores the association between signals and functions to be executed,
+	// a function returning a non nil error ends the execution, while returning nil lets it continue.
+	// The context they receive gets canceled as soon as the execution starts ending, for any reason,
+	// so long-running handlers can abort.
+	SimpleHandlers map[os.Signal]simpleHandlerFn
 )
 
-// RegisterSignalHandlers sets up the signal handlers we want to use
-func RegisterSignalHandlers(handlers SignalHandlers) *w {
+// DefaultSignalHandlers returns the handlers for the common case of exiting cleanly on SIGINT and SIGTERM.
+// The returned map can be extended with other handlers before being passed to RegisterSignalHandlers.
+func DefaultSignalHandlers() SignalHandlers {
+	return SignalHandlers{
+		os.Interrupt:    exitCleanly,
+		syscall.SIGTERM: exitCleanly,
+	}
+}
+
+func exitCleanly(status chan int) {
+	status <- 0
+}
+
+// handlersBuilder builds a SignalHandlers map, adapting simpler functions to signal handlers
+type handlersBuilder struct {
+	h SimpleHandlers
+}
+
+// NewHandlers returns a builder for SignalHandlers:
+//
+//	handlers := NewHandlers().OnReload(syscall.SIGHUP, reload).OnExit(syscall.SIGTERM, cleanup).Build()
+//	os.Exit(wrapper.RegisterSignalHandlers(handlers).Exec(run))
+func NewHandlers() *handlersBuilder {
+	return &handlersBuilder{h: make(SimpleHandlers)}
+}
+
+// OnReload sets fn as the handler for sig, which lets the execution continue after fn returns
+func (b *handlersBuilder) OnReload(sig os.Signal, fn func()) *handlersBuilder {
+	b.h[sig] = func(context.Context) error {
+		fn()
+		return nil
+	}
+	return b
+}
+
+// OnExit sets fn as the handler for sig, which ends the execution after fn returns.
+// The handlers returned by Build push the exit code of fn's error: 0 if it's nil, the code of an ExitError,
+// or 1 for any other error, while the ones returned by BuildSimple end the execution with the error itself.
+func (b *handlersBuilder) OnExit(sig os.Signal, fn func() error) *handlersBuilder {
+	b.h[sig] = func(context.Context) error {
+		if err := fn(); err != nil {
+			return err
+		}
+		return ExitError{}
+	}
+	return b
+}
+
+// Build returns the handlers, which can be passed to RegisterSignalHandlers
+func (b *handlersBuilder) Build() SignalHandlers {
+	h := make(SignalHandlers, len(b.h))
+	for sig, fn := range b.h {
+		fn := fn
+		h[sig] = func(status chan int) {
+			if err := fn(context.Background()); err != nil {
+				status <- exitCode(err)
+			}
+		}
+	}
+	return h
+}
+
+// BuildSimple returns the handlers as SimpleHandlers, which can be passed to RegisterSimpleHandlers,
+// so the execution ends with the error returned by the OnExit functions, instead of its exit code.
+func (b *handlersBuilder) BuildSimple() SimpleHandlers {
+	h := make(SimpleHandlers, len(b.h))
+	for sig, fn := range b.h {
+		h[sig] = fn
+	}
+	return h
+}
+
+// WithPanicHandler sets the function that gets called when a signal handler panics.
+// If it returns a non nil error, the execution ends with it, otherwise it continues as normal.
+// Without it, a panicking handler ends the execution with an error containing the stack trace.
+func WithPanicHandler(fn func(sig os.Signal, r interface{}) error) OptionFn {
+	return func(w *w) {
+		if fn == nil {
+			fn = defaultPanicFn
+		}
+		w.panicFn = fn
+	}
+}
+
+// WithOnStop sets a function that gets called once when the execution ends, regardless of the reason.
+// Its error is joined with the one returned by ExecContext.
+func WithOnStop(fn func(context.Context) error) OptionFn {
+	return func(w *w) {
+		w.stopFn = fn
+	}
+}
+
+// WithStopTimeout sets the duration after which the context passed to the WithOnStop function gets canceled.
+// A zero duration means no timeout.
+func WithStopTimeout(d time.Duration) OptionFn {
+	return func(w *w) {
+		w.stopTimeout = d
+	}
+}
+
+// WithDebounce collapses the deliveries of sig that happen in an interval d after its handler
+// has been executed into that single execution.
+// Only sig is affected, so signals which are used to force exiting, like a second SIGINT,
+// should not be debounced.
+func WithDebounce(sig os.Signal, d time.Duration) OptionFn {
+	return func(w *w) {
+		w.debounce[sig] = d
+	}
+}
+
+// WithSignalTimeout sets the duration after which the context passed to the handler for sig gets canceled,
+// from the time it's called, so a handler ending the execution, like the one for SIGTERM, can bound its cleanup
+// by the context's deadline. Only the SimpleHandlers receive the context.
+func WithSignalTimeout(sig os.Signal, d time.Duration) OptionFn {
+	return func(w *w) {
+		w.timeout[sig] = d
+	}
+}
+
+// WithCleanExitErrors makes the execution ending with any of errs, as checked by errors.Is, be treated as a clean exit.
+func WithCleanExitErrors(errs ...error) OptionFn {
+	return func(w *w) {
+		w.cleanErrs = append(w.cleanErrs, errs...)
+	}
+}
+
+// WithDefaultHandler sets fn as the handler for the received signals which don't have one of their own.
+// The wrapper also receives sigs, in addition to the signals that have handlers, so they get handled by fn.
+func WithDefaultHandler(fn handlerExtFn, sigs ...os.Signal) OptionFn {
+	return func(w *w) {
+		w.defaultFn = fn.handler()
+		w.defaultSigs = append(w.defaultSigs, sigs...)
+	}
+}
+
+// WithSignalObserver calls fn with every signal received, before executing its handler,
+// including the ones that get debounced, or whose handler has been removed.
+func WithSignalObserver(fn func(os.Signal)) OptionFn {
+	return func(w *w) {
+		w.observeFn = fn
+	}
+}
+
+// WithSignalSource makes the wrapper receive the signals from ch, instead of the os,
+// which allows testing the handlers without sending real signals to the process.
+func WithSignalSource(ch chan os.Signal) OptionFn {
+	return func(w *w) {
+		w.signal = ch
+		w.external = true
+	}
+}
+
+// RestartPolicy defines how the function passed to Exec or ExecContext gets restarted when it fails
+type RestartPolicy struct {
+	// MaxRestarts is the number of times the function is restarted, zero meaning no limit
+	MaxRestarts int
+	// Backoff is the delay before the first restart, which is doubled for every subsequent one.
+	// It's at least 10ms, so a function failing right away doesn't get restarted in a tight loop.
+	Backoff time.Duration
+	// MaxBackoff limits the delay between restarts, if it's not zero
+	MaxBackoff time.Duration
+}
+
+// minRestartBackoff is the minimum delay between the restarts of the function
+const minRestartBackoff = 10 * time.Millisecond
+
+// WithRestart runs the function passed to Exec or ExecContext again when it returns an error
+// which doesn't end the execution cleanly and isn't an ExitError, following policy.
+// When the restarts are exhausted, the execution ends with the last error.
+func WithRestart(policy RestartPolicy) OptionFn {
+	return func(w *w) {
+		w.restart = &policy
+	}
+}
+
+// WithLogger logs the received signals, the execution of their handlers and the cause of the execution ending to l.
+// By default nothing is logged.
+func WithLogger(l interface{ Printf(string, ...interface{}) }) OptionFn {
+	return func(w *w) {
+		if l == nil {
+			w.logFn = nopLogFn
+			return
+		}
+		w.logFn = l.Printf
+	}
+}
+
+func nopLogFn(string, ...interface{}) {}
+
+// RegisterSignalHandlers sets up the signal handlers we want to use.
+// The handlers are executed one at a time, in the order the signals have been received,
+// so a handler doesn't need to guard against being executed concurrently with another one.
+func RegisterSignalHandlers(handlers SignalHandlers, opts ...OptionFn) *w {
+	h := make(map[os.Signal]sigHandler, len(handlers))
+	for sig, fn := range handlers {
+		h[sig] = fn.handler()
+	}
+	return register(h, opts...)
+}
+
+// RegisterSignalHandlersErr is like RegisterSignalHandlers, but it returns an error if handlers is empty,
+// or if any of its handlers is nil, instead of the nil handlers panicking when their signal is received.
+func RegisterSignalHandlersErr(handlers SignalHandlers, opts ...OptionFn) (*w, error) {
+	if len(handlers) == 0 {
+		return nil, fmt.Errorf("no signal handlers have been passed")
+	}
+	for sig, fn := range handlers {
+		if fn == nil {
+			return nil, fmt.Errorf("nil handler for signal %s", sig)
+		}
+	}
+	return RegisterSignalHandlers(handlers, opts...), nil
+}
+
+// RegisterSignalHandlersExt sets up the signal handlers we want to use, passing the received signal to them
+func RegisterSignalHandlersExt(handlers SignalHandlersExt, opts ...OptionFn) *w {
+	h := make(map[os.Signal]sigHandler, len(handlers))
+	for sig, fn := range handlers {
+		h[sig] = fn.handler()
+	}
+	return register(h, opts...)
+}
+
+// RegisterSimpleHandlers sets up signal handlers which return an error instead of pushing an exit code
+func RegisterSimpleHandlers(handlers SimpleHandlers, opts ...OptionFn) *w {
+	h := make(map[os.Signal]sigHandler, len(handlers))
+	for sig, fn := range handlers {
+		h[sig] = fn.handler()
+	}
+	return register(h, opts...)
+}
+
+func register(handlers map[os.Signal]sigHandler, opts ...OptionFn) *w {
 	x := &w{
-		signal: make(chan os.Signal, 1),
-		status: make(chan int, 1),
-		h:      handlers,
+		signal:  make(chan os.Signal, 1),
+		status:  make(chan int, 1),
+		err:     make(chan error, 1),
+		h:       handlers,
+		panicFn: defaultPanicFn,
+		logFn:   nopLogFn,
+
+		debounce: make(map[os.Signal]time.Duration),
+		timeout:  make(map[os.Signal]time.Duration),
+		fired:    make(map[os.Signal]time.Time),
+	}
+	for _, opt := range opts {
+		opt(x)
 	}
 	signals := make([]os.Signal, 0)
 	for sig := range handlers {
 		signals = append(signals, sig)
 	}
-	signal.Notify(x.signal, signals...)
+	if x.defaultFn != nil {
+		signals = append(signals, x.defaultSigs...)
+	}
+	if !x.external {
+		signal.Notify(x.signal, signals...)
+	}
 	return x
 }
 
+func defaultPanicFn(sig os.Signal, r interface{}) error {
+	return fmt.Errorf("signal handler for %s panicked: %v\n%s", sig, r, debug.Stack())
+}
+
+func (fn handlerFn) handler() sigHandler {
+	return func(_ context.Context, _ os.Signal, status chan int) error {
+		fn(status)
+		return nil
+	}
+}
+
+func (fn handlerExtFn) handler() sigHandler {
+	return func(_ context.Context, sig os.Signal, status chan int) error {
+		fn(sig, status)
+		return nil
+	}
+}
+
+func (fn simpleHandlerFn) handler() sigHandler {
+	return func(ctx context.Context, _ os.Signal, _ chan int) error {
+		return fn(ctx)
+	}
+}
+
+// Handle registers fn as the handler for sig, replacing the existing one if present.
+// It can be called after Exec has started.
+func (ww *w) Handle(sig os.Signal, fn handlerFn) {
+	ww.m.Lock()
+	defer ww.m.Unlock()
+
+	ww.h[sig] = fn.handler()
+	if !ww.external {
+		signal.Notify(ww.signal, sig)
+	}
+}
+
+// Unhandle removes the handler for sig and restores the default behaviour for it.
+// It can be called after Exec has started.
+func (ww *w) Unhandle(sig os.Signal) {
+	ww.m.Lock()
+	defer ww.m.Unlock()
+
+	delete(ww.h, sig)
+	if !ww.external {
+		signal.Reset(sig)
+	}
+}
+
+// Shutdown ends the execution with err, like a signal handler returning it, while nil ends it cleanly.
+// It's meant to be called by the function passed to Exec or ExecContext, which can continue cleaning up
+// until its context gets canceled.
+func (ww *w) Shutdown(err error) {
+	if err == nil {
+		err = ExitError{}
+	}
+	ww.exit(err)
+}
+
+func (ww *w) handler(sig os.Signal) (sigHandler, bool) {
+	ww.m.Lock()
+	defer ww.m.Unlock()
+
+	fn, ok := ww.h[sig]
+	if !ok && ww.defaultFn != nil {
+		return ww.defaultFn, true
+	}
+	return fn, ok
+}
+
+// fnErrWait is the time ExecContext waits for the function to return, when a handler ends the execution with an error
+const fnErrWait = 100 * time.Millisecond
+
+// ExitError is the error returned by ExecContext when the execution was ended with a non zero exit code,
+// either pushed by a signal handler or returned by Exit. Callers can retrieve the code with errors.As
+// and use it for os.Exit:
+//
+//	var exit wrapper.ExitError
+//	if errors.As(err, &exit) {
+//		os.Exit(exit.Code)
+//	}
+type ExitError struct {
+	Code int
+}
+
+func (e ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// Exit returns an error that ends the execution with code, to be used by handlers that return errors.
+// A zero code ends the execution without an error.
+func Exit(code int) error {
+	return ExitError{Code: code}
+}
+
+func statusError(st int) error {
+	return ExitError{Code: st}
+}
+
+// cleanExit returns nil if err is an ExitError with a zero code, or one of the WithCleanExitErrors errors
+func (ww *w) cleanExit(err error) error {
+	var exit ExitError
+	if errors.As(err, &exit) && exit.Code == 0 {
+		return nil
+	}
+	for _, clean := range ww.cleanErrs {
+		if errors.Is(err, clean) {
+			return nil
+		}
+	}
+	return err
+}
+
 // Exec reads signals received from the os and executes the handlers it has registered
 func (ww *w) Exec(fn func() error) int {
-	go func() {
-		if fn() != nil {
-			ww.status <- 1
+	err := ww.ExecContext(context.Background(), func(ctx context.Context) error {
+		if err := fn(); err != nil {
+			return err
 		}
+		<-ctx.Done()
+		return nil
+	})
+	return exitCode(err)
+}
+
+// exitCode returns the exit code corresponding to err
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exit ExitError
+	if errors.As(err, &exit) {
+		return exit.Code
+	}
+	return 1
+}
+
+// ExecContext reads signals received from the os and executes the handlers it has registered,
+// while running fn with a context that gets canceled when ExecContext returns.
+// Before returning it waits for any running signal handler to finish, fn is expected to return
+// when its context is canceled.
+// It returns when fn returns, when a handler pushes an exit code, or when ctx is canceled,
+// in which case the context's error is returned.
+// A non zero exit code is returned as an ExitError.
+// Only the first of the exit codes and errors that end the execution is returned, the ones pushed
+// by the handlers afterwards are discarded, without blocking them.
+// When a handler ends the execution with an error, the error fn returns shortly after is joined to it.
+// The signals stop being received when it returns, so they get their default behaviour back.
+func (ww *w) ExecContext(ctx context.Context, fn func(context.Context) error) error {
+	if !ww.external {
+		defer signal.Stop(ww.signal)
+	}
+	runCtx, cancelFn := context.WithCancel(ctx)
+	defer cancelFn()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ww.run(runCtx, fn)
+	}()
+	waitDone := make(chan struct{})
+	go func() {
+		ww.wait(runCtx)
+		close(waitDone)
 	}()
-	go func(ex *w) {
-		for {
-			select {
-			case s := <-ex.signal:
-				ex.h[s](ex.status)
+
+	var err error
+	fnReturned := false
+	select {
+	case st := <-ww.status:
+		ww.logFn("exiting with status %d pushed by a signal handler", st)
+		err = statusError(st)
+	case err = <-errCh:
+		ww.logFn("exiting after the function returned: %v", err)
+		fnReturned = true
+	case err = <-ww.err:
+		ww.logFn("exiting with error: %v", err)
+	case <-ctx.Done():
+		ww.logFn("exiting after the context ended: %v", ctx.Err())
+	}
+	// stop the signal loop and wait for it to finish, so no goroutines outlive the execution
+	cancelFn()
+	ww.drain(waitDone)
+
+	if !fnReturned && ww.cleanExit(err) != nil {
+		// fn might fail too when the execution ends with an error, so we give it a chance to report that
+		select {
+		case fnErr := <-errCh:
+			if fnErr != nil && !errors.Is(fnErr, context.Canceled) {
+				err = errors.Join(err, fnErr)
+			}
+		case <-time.After(fnErrWait):
+		}
+	}
+
+	if ctx.Err() != nil {
+		// the parent context has been canceled, we don't want to return an error caused by that from fn
+		err = ctx.Err()
+	}
+	err = ww.cleanExit(err)
+	if stopErr := ww.stop(); stopErr != nil {
+		err = errors.Join(err, stopErr)
+	}
+	return err
+}
+
+// run calls fn, restarting it according to the restart policy, until it succeeds or ctx is canceled
+func (ww *w) run(ctx context.Context, fn func(context.Context) error) error {
+	backoff := time.Duration(0)
+	for restarts := 0; ; restarts++ {
+		err := fn(ctx)
+		var exit ExitError
+		if err == nil || ww.restart == nil || ww.cleanExit(err) == nil || errors.As(err, &exit) || ctx.Err() != nil {
+			return err
+		}
+		if ww.restart.MaxRestarts > 0 && restarts >= ww.restart.MaxRestarts {
+			return err
+		}
+		if backoff == 0 {
+			backoff = ww.restart.Backoff
+		} else {
+			backoff *= 2
+		}
+		if ww.restart.MaxBackoff > 0 && backoff > ww.restart.MaxBackoff {
+			backoff = ww.restart.MaxBackoff
+		}
+		if backoff < minRestartBackoff {
+			backoff = minRestartBackoff
+		}
+		ww.logFn("restarting in %s after error: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// stop calls the WithOnStop function, with a context bound by the stop timeout
+func (ww *w) stop() error {
+	if ww.stopFn == nil {
+		return nil
+	}
+	// the execution context is already canceled at this point, so we don't derive from it
+	ctx := context.Background()
+	if ww.stopTimeout > 0 {
+		var cancelFn context.CancelFunc
+		ctx, cancelFn = context.WithTimeout(ctx, ww.stopTimeout)
+		defer cancelFn()
+	}
+	return ww.stopFn(ctx)
+}
+
+// ExecAll runs all fns concurrently with the same signal handling as ExecContext.
+// The execution ends when all of them return, when one of them returns an error, in which case
+// the context of the others gets canceled, or when a handler requests it.
+// The errors of all the functions that failed are joined together.
+func (ww *w) ExecAll(ctx context.Context, fns ...func(context.Context) error) error {
+	return ww.ExecContext(ctx, func(ctx context.Context) error {
+		ctx, cancelFn := context.WithCancel(ctx)
+		defer cancelFn()
+
+		errs := make([]error, len(fns))
+		wg := sync.WaitGroup{}
+		for i, fn := range fns {
+			wg.Add(1)
+			go func(i int, fn func(context.Context) error) {
+				defer wg.Done()
+				err := fn(ctx)
+				if err == nil || errors.Is(err, context.Canceled) && ctx.Err() != nil {
+					// we ignore the errors caused by the cancellation of the other functions
+					return
+				}
+				errs[i] = err
+				cancelFn()
+			}(i, fn)
+		}
+		wg.Wait()
+		return errors.Join(errs...)
+	})
+}
+
+// drain discards the exit codes and errors pushed by the handlers still running, until done is closed.
+func (ww *w) drain(done <-chan struct{}) {
+	for {
+		select {
+		case <-ww.status:
+		case <-ww.err:
+		case <-done:
+			return
+		}
+	}
+}
+
+// wait executes the handlers in the same goroutine that receives the signals, which serializes them
+func (ww *w) wait(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-ww.signal:
+			ww.logFn("received signal %s", s)
+			if ww.observeFn != nil {
+				ww.observeFn(s)
+			}
+			if ww.debounced(s) {
+				ww.logFn("ignoring debounced signal %s", s)
+				continue
 			}
+			ww.handle(ctx, s)
 		}
-	}(ww)
-	return <- ww.status
+	}
+}
+
+// debounced returns true if the handler for s has been executed less than its debounce interval ago
+func (ww *w) debounced(s os.Signal) bool {
+	d, ok := ww.debounce[s]
+	if !ok {
+		return false
+	}
+	now := time.Now()
+	if last, ok := ww.fired[s]; ok && now.Sub(last) < d {
+		return true
+	}
+	ww.fired[s] = now
+	return false
+}
+
+// handle executes the handler for the received signal, recovering from any panic it might raise
+func (ww *w) handle(ctx context.Context, s os.Signal) {
+	fn, ok := ww.handler(s)
+	if !ok {
+		// the handler has been removed after the signal was received, and there's no default one
+		ww.logFn("no handler for signal %s", s)
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			ww.logFn("the handler for signal %s panicked: %v", s, r)
+			ww.exit(ww.panicFn(s, r))
+		}
+	}()
+	if d := ww.timeout[s]; d > 0 {
+		// the handlers which end the execution get to know how much time they have to clean up
+		var cancelFn context.CancelFunc
+		ctx, cancelFn = context.WithTimeout(ctx, d)
+		defer cancelFn()
+	}
+	ww.logFn("executing the handler for signal %s", s)
+	err := fn(ctx, s, ww.status)
+	ww.logFn("the handler for signal %s finished", s)
+	ww.exit(err)
+}
+
+// exit ends the execution with err if it's not nil
+func (ww *w) exit(err error) {
+	if err == nil {
+		return
+	}
+	select {
+	case ww.err <- err:
+	default:
+		// the execution is already ending
+	}
 }
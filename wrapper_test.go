@@ -0,0 +1,768 @@
+package wrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testTimeout bounds the waits of the tests, so a broken test fails instead of hanging
+const testTimeout = 5 * time.Second
+
+// execAsync runs ExecContext in a goroutine, returning the channel it sends its result on
+func execAsync(ww *w, ctx context.Context, fn func(context.Context) error) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- ww.ExecContext(ctx, fn)
+	}()
+	return done
+}
+
+// waitCtx is a function for ExecContext which runs until its context gets canceled
+func waitCtx(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+// result waits for the result of an execution started with execAsync
+func result(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(testTimeout):
+		t.Fatalf("the execution didn't end in %s", testTimeout)
+		return nil
+	}
+}
+
+// send delivers sig to the wrapper through its signal source
+func send(t *testing.T, src chan<- os.Signal, sig os.Signal) {
+	t.Helper()
+	select {
+	case src <- sig:
+	case <-time.After(testTimeout):
+		t.Fatalf("signal %s has not been received in %s", sig, testTimeout)
+	}
+}
+
+// checkGoroutines returns a function that fails the test if the number of goroutines doesn't get back
+// to the one at the time checkGoroutines has been called
+func checkGoroutines(t *testing.T) func() {
+	t.Helper()
+	before := runtime.NumGoroutine()
+	return func() {
+		t.Helper()
+		after := 0
+		for end := time.Now().Add(time.Second); time.Now().Before(end); time.Sleep(10 * time.Millisecond) {
+			if after = runtime.NumGoroutine(); after <= before {
+				return
+			}
+		}
+		t.Errorf("%d goroutines are still running after the test, expected %d", after, before)
+	}
+}
+
+func TestSignalHandlersExt(t *testing.T) {
+	src := make(chan os.Signal)
+	received := make(chan os.Signal, 1)
+	fn := func(sig os.Signal, _ chan int) {
+		received <- sig
+	}
+	ww := RegisterSignalHandlersExt(SignalHandlersExt{syscall.SIGHUP: fn, syscall.SIGTERM: fn}, WithSignalSource(src))
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	done := execAsync(ww, ctx, waitCtx)
+	for _, sig := range []os.Signal{syscall.SIGHUP, syscall.SIGTERM, syscall.SIGHUP} {
+		send(t, src, sig)
+		if got := <-received; got != sig {
+			t.Errorf("the handler received %s, expected %s", got, sig)
+		}
+	}
+	cancelFn()
+	result(t, done)
+}
+
+func TestExecContextDeadline(t *testing.T) {
+	fns := map[string]func(context.Context) error{
+		"returning nil": waitCtx,
+		"returning the context error": func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	for name, fn := range fns {
+		t.Run(name, func(t *testing.T) {
+			ww := RegisterSignalHandlers(DefaultSignalHandlers(), WithSignalSource(make(chan os.Signal)))
+			ctx, cancelFn := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancelFn()
+
+			if err := result(t, execAsync(ww, ctx, fn)); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("ExecContext returned %v, expected %v", err, context.DeadlineExceeded)
+			}
+		})
+	}
+}
+
+func TestPanickingHandler(t *testing.T) {
+	panicking := SignalHandlers{
+		syscall.SIGHUP: func(chan int) {
+			panic("boom")
+		},
+	}
+
+	t.Run("default", func(t *testing.T) {
+		src := make(chan os.Signal)
+		ww := RegisterSignalHandlers(panicking, WithSignalSource(src))
+		done := execAsync(ww, context.Background(), waitCtx)
+		send(t, src, syscall.SIGHUP)
+
+		err := result(t, done)
+		if err == nil || !strings.Contains(err.Error(), "panicked: boom") {
+			t.Errorf("ExecContext returned %v, expected the panic error", err)
+		}
+	})
+	t.Run("with panic handler", func(t *testing.T) {
+		src := make(chan os.Signal)
+		recovered := make(chan interface{}, 1)
+		ww := RegisterSignalHandlers(panicking, WithSignalSource(src), WithPanicHandler(func(sig os.Signal, r interface{}) error {
+			recovered <- r
+			return nil
+		}))
+		ctx, cancelFn := context.WithCancel(context.Background())
+		done := execAsync(ww, ctx, waitCtx)
+		send(t, src, syscall.SIGHUP)
+		if r := <-recovered; r != "boom" {
+			t.Errorf("the panic handler received %v, expected boom", r)
+		}
+		// the execution continues after the panic handler returns nil
+		send(t, src, syscall.SIGHUP)
+		<-recovered
+		cancelFn()
+		if err := result(t, done); !errors.Is(err, context.Canceled) {
+			t.Errorf("ExecContext returned %v, expected %v", err, context.Canceled)
+		}
+	})
+}
+
+func TestSimpleHandlers(t *testing.T) {
+	src := make(chan os.Signal)
+	errStop := errors.New("stop")
+	reloads := make(chan struct{}, 1)
+	ww := RegisterSimpleHandlers(SimpleHandlers{
+		syscall.SIGHUP: func(context.Context) error {
+			reloads <- struct{}{}
+			return nil
+		},
+		syscall.SIGTERM: func(context.Context) error {
+			return errStop
+		},
+	}, WithSignalSource(src))
+	done := execAsync(ww, context.Background(), waitCtx)
+
+	for i := 0; i < 2; i++ {
+		send(t, src, syscall.SIGHUP)
+		<-reloads
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("the execution ended with %v after a handler returned nil", err)
+	default:
+	}
+	send(t, src, syscall.SIGTERM)
+	if err := result(t, done); !errors.Is(err, errStop) {
+		t.Errorf("ExecContext returned %v, expected %v", err, errStop)
+	}
+}
+
+func TestNewHandlers(t *testing.T) {
+	errStop := errors.New("stop")
+	tests := map[string]struct {
+		exitErr, expected, expectedSimple error
+	}{
+		"clean":     {nil, nil, nil},
+		"error":     {errStop, ExitError{Code: 1}, errStop},
+		"exit code": {Exit(3), ExitError{Code: 3}, ExitError{Code: 3}},
+	}
+	for name, tt := range tests {
+		for _, simple := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/simple=%t", name, simple), func(t *testing.T) {
+				src := make(chan os.Signal)
+				reloads := make(chan struct{}, 1)
+				b := NewHandlers().OnReload(syscall.SIGHUP, func() {
+					reloads <- struct{}{}
+				}).OnExit(syscall.SIGTERM, func() error {
+					return tt.exitErr
+				})
+				ww, expected := RegisterSignalHandlers(b.Build(), WithSignalSource(src)), tt.expected
+				if simple {
+					ww, expected = RegisterSimpleHandlers(b.BuildSimple(), WithSignalSource(src)), tt.expectedSimple
+				}
+				done := execAsync(ww, context.Background(), waitCtx)
+
+				for i := 0; i < 2; i++ {
+					send(t, src, syscall.SIGHUP)
+					<-reloads
+				}
+				select {
+				case err := <-done:
+					t.Fatalf("the execution ended with %v after a reload", err)
+				default:
+				}
+				send(t, src, syscall.SIGTERM)
+				if err := result(t, done); !errors.Is(err, expected) {
+					t.Errorf("ExecContext returned %v, expected %v", err, expected)
+				}
+			})
+		}
+	}
+}
+
+func TestHandleAfterStart(t *testing.T) {
+	src := make(chan os.Signal)
+	handled := make(chan struct{}, 1)
+	ww := RegisterSignalHandlers(DefaultSignalHandlers(), WithSignalSource(src))
+	done := execAsync(ww, context.Background(), waitCtx)
+
+	ww.Handle(syscall.SIGHUP, func(chan int) {
+		handled <- struct{}{}
+	})
+	send(t, src, syscall.SIGHUP)
+	select {
+	case <-handled:
+	case <-time.After(testTimeout):
+		t.Fatalf("the handler added after the start has not been executed")
+	}
+
+	ww.Unhandle(syscall.SIGHUP)
+	send(t, src, syscall.SIGHUP)
+	send(t, src, syscall.SIGTERM)
+	if err := result(t, done); err != nil {
+		t.Errorf("ExecContext returned %v, expected no error", err)
+	}
+	if len(handled) > 0 {
+		t.Errorf("the removed handler has been executed")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := map[string]func(src chan os.Signal) *w{
+		"pushed by a handler": func(src chan os.Signal) *w {
+			return RegisterSignalHandlers(SignalHandlers{
+				syscall.SIGTERM: func(status chan int) {
+					status <- 3
+				},
+			}, WithSignalSource(src))
+		},
+		"returned by a handler": func(src chan os.Signal) *w {
+			return RegisterSimpleHandlers(SimpleHandlers{
+				syscall.SIGTERM: func(context.Context) error {
+					return Exit(3)
+				},
+			}, WithSignalSource(src))
+		},
+	}
+	for name, register := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := make(chan os.Signal)
+			done := execAsync(register(src), context.Background(), waitCtx)
+			send(t, src, syscall.SIGTERM)
+
+			var exit ExitError
+			if err := result(t, done); !errors.As(err, &exit) || exit.Code != 3 {
+				t.Errorf("ExecContext returned %v, expected exit status 3", err)
+			}
+		})
+	}
+	t.Run("Exec", func(t *testing.T) {
+		ww := RegisterSignalHandlers(DefaultSignalHandlers(), WithSignalSource(make(chan os.Signal)))
+		if code := ww.Exec(func() error { return Exit(4) }); code != 4 {
+			t.Errorf("Exec returned %d, expected 4", code)
+		}
+	})
+}
+
+func TestNoGoroutineLeak(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	errFail := errors.New("fail")
+	for i := 0; i < 100; i++ {
+		ww := RegisterSignalHandlers(DefaultSignalHandlers(), WithSignalSource(make(chan os.Signal)))
+		if err := ww.ExecContext(context.Background(), func(context.Context) error { return nil }); err != nil {
+			t.Fatalf("ExecContext returned %v, expected no error", err)
+		}
+		ww = RegisterSignalHandlers(DefaultSignalHandlers(), WithSignalSource(make(chan os.Signal)))
+		if err := ww.ExecContext(context.Background(), func(context.Context) error { return errFail }); !errors.Is(err, errFail) {
+			t.Fatalf("ExecContext returned %v, expected %v", err, errFail)
+		}
+	}
+}
+
+func TestExecAll(t *testing.T) {
+	ww := RegisterSignalHandlers(DefaultSignalHandlers(), WithSignalSource(make(chan os.Signal)))
+	errFail := errors.New("fail")
+	canceled := make(chan error, 1)
+
+	err := ww.ExecAll(context.Background(),
+		func(ctx context.Context) error {
+			<-ctx.Done()
+			canceled <- ctx.Err()
+			return ctx.Err()
+		},
+		func(context.Context) error {
+			return errFail
+		},
+	)
+	if !errors.Is(err, errFail) {
+		t.Errorf("ExecAll returned %v, expected %v", err, errFail)
+	}
+	if errors.Is(err, context.Canceled) {
+		t.Errorf("ExecAll returned %v, which includes the cancellation of the other function", err)
+	}
+	select {
+	case err := <-canceled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("the context of the other function ended with %v, expected %v", err, context.Canceled)
+		}
+	default:
+		t.Errorf("the context of the other function has not been canceled")
+	}
+}
+
+func TestHandlerAndFunctionErrors(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	errSignal := errors.New("signal")
+	errFn := errors.New("function")
+	src := make(chan os.Signal)
+	ww := RegisterSimpleHandlers(SimpleHandlers{
+		syscall.SIGTERM: func(context.Context) error {
+			return errSignal
+		},
+	}, WithSignalSource(src))
+
+	// the function fails as its context gets canceled by the handler's error
+	done := execAsync(ww, context.Background(), func(ctx context.Context) error {
+		<-ctx.Done()
+		return errFn
+	})
+	send(t, src, syscall.SIGTERM)
+	err := result(t, done)
+	if !errors.Is(err, errSignal) || !errors.Is(err, errFn) {
+		t.Fatalf("ExecContext returned %v, expected both %v and %v", err, errSignal, errFn)
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); !ok || joined.Unwrap()[0] != errSignal {
+		t.Errorf("ExecContext returned %v, expected %v to be the first error", err, errSignal)
+	}
+}
+
+func TestWithRestart(t *testing.T) {
+	errFail := errors.New("fail")
+	t.Run("succeeds", func(t *testing.T) {
+		// the zero policy restarts without a limit, but not in a tight loop
+		ww := RegisterSignalHandlers(DefaultSignalHandlers(), WithSignalSource(make(chan os.Signal)), WithRestart(RestartPolicy{}))
+		calls := 0
+		begin := time.Now()
+		err := ww.ExecContext(context.Background(), func(ctx context.Context) error {
+			calls++
+			if calls <= 2 {
+				return errFail
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("ExecContext returned %v, expected no error", err)
+		}
+		if calls != 3 {
+			t.Errorf("the function has been called %d times, expected 3", calls)
+		}
+		if d := time.Since(begin); d < 2*minRestartBackoff {
+			t.Errorf("the function has been restarted twice in %s, expected at least %s", d, 2*minRestartBackoff)
+		}
+	})
+	t.Run("exhausted", func(t *testing.T) {
+		ww := RegisterSignalHandlers(DefaultSignalHandlers(), WithSignalSource(make(chan os.Signal)),
+			WithRestart(RestartPolicy{MaxRestarts: 2, Backoff: time.Millisecond}))
+		calls := 0
+		err := ww.ExecContext(context.Background(), func(ctx context.Context) error {
+			calls++
+			return fmt.Errorf("attempt %d: %w", calls, errFail)
+		})
+		if !errors.Is(err, errFail) || err.Error() != "attempt 3: fail" {
+			t.Errorf("ExecContext returned %v, expected the error of the last attempt", err)
+		}
+		if calls != 3 {
+			t.Errorf("the function has been called %d times, expected 3", calls)
+		}
+	})
+	t.Run("exit", func(t *testing.T) {
+		ww := RegisterSignalHandlers(DefaultSignalHandlers(), WithSignalSource(make(chan os.Signal)), WithRestart(RestartPolicy{}))
+		calls := 0
+		err := ww.ExecContext(context.Background(), func(ctx context.Context) error {
+			calls++
+			return Exit(2)
+		})
+		if exitCode(err) != 2 || calls != 1 {
+			t.Errorf("ExecContext returned %v after %d calls, expected exit status 2 without restarts", err, calls)
+		}
+	})
+}
+
+func TestWithSignalTimeout(t *testing.T) {
+	const window = 2 * time.Second
+	src := make(chan os.Signal)
+	reloaded := make(chan bool, 1)
+	var remaining time.Duration
+	ww := RegisterSimpleHandlers(SimpleHandlers{
+		syscall.SIGHUP: func(ctx context.Context) error {
+			_, ok := ctx.Deadline()
+			reloaded <- ok
+			return nil
+		},
+		syscall.SIGTERM: func(ctx context.Context) error {
+			if d, ok := ctx.Deadline(); ok {
+				remaining = time.Until(d)
+			}
+			return Exit(0)
+		},
+	}, WithSignalSource(src), WithSignalTimeout(syscall.SIGTERM, window), WithStopTimeout(time.Minute))
+	done := execAsync(ww, context.Background(), waitCtx)
+
+	// the stop timeout doesn't apply to the handlers
+	send(t, src, syscall.SIGHUP)
+	if <-reloaded {
+		t.Errorf("the context of the SIGHUP handler has a deadline, expected none")
+	}
+	send(t, src, syscall.SIGTERM)
+	if err := result(t, done); err != nil {
+		t.Errorf("ExecContext returned %v, expected no error", err)
+	}
+	if remaining <= window-200*time.Millisecond || remaining > window {
+		t.Errorf("the SIGTERM handler had %s left, expected about %s", remaining, window)
+	}
+}
+
+func TestOnStop(t *testing.T) {
+	errStop := errors.New("stop")
+	errFail := errors.New("fail")
+	for i := 0; i < 20; i++ {
+		src := make(chan os.Signal)
+		calls := 0
+		ww := RegisterSimpleHandlers(SimpleHandlers{
+			syscall.SIGTERM: func(context.Context) error {
+				return errFail
+			},
+		}, WithSignalSource(src), WithOnStop(func(ctx context.Context) error {
+			calls++
+			if _, ok := ctx.Deadline(); !ok {
+				t.Errorf("the context of the stop function has no deadline")
+			}
+			return errStop
+		}), WithStopTimeout(time.Second))
+
+		// the handler and the function race to end the execution
+		err := ww.ExecContext(context.Background(), func(ctx context.Context) error {
+			src <- syscall.SIGTERM
+			return errFail
+		})
+		if !errors.Is(err, errFail) || !errors.Is(err, errStop) {
+			t.Errorf("ExecContext returned %v, expected both %v and %v", err, errFail, errStop)
+		}
+		if calls != 1 {
+			t.Fatalf("the stop function has been called %d times, expected once", calls)
+		}
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	src := make(chan os.Signal)
+	calls := 0
+	ww := RegisterSignalHandlers(SignalHandlers{
+		syscall.SIGHUP: func(chan int) {
+			calls++
+		},
+		syscall.SIGTERM: exitCleanly,
+	}, WithSignalSource(src), WithDebounce(syscall.SIGHUP, time.Second))
+	done := execAsync(ww, context.Background(), waitCtx)
+
+	for i := 0; i < 3; i++ {
+		send(t, src, syscall.SIGHUP)
+		time.Sleep(10 * time.Millisecond)
+	}
+	send(t, src, syscall.SIGTERM)
+	if err := result(t, done); err != nil {
+		t.Errorf("ExecContext returned %v, expected no error", err)
+	}
+	if calls != 1 {
+		t.Errorf("the debounced handler has been called %d times, expected once", calls)
+	}
+}
+
+func TestWithCleanExitErrors(t *testing.T) {
+	errDone := errors.New("done")
+	ww := RegisterSignalHandlers(DefaultSignalHandlers(), WithSignalSource(make(chan os.Signal)), WithCleanExitErrors(errDone))
+	if code := ww.Exec(func() error { return errDone }); code != 0 {
+		t.Errorf("Exec returned %d, expected 0", code)
+	}
+
+	ww = RegisterSignalHandlers(DefaultSignalHandlers(), WithSignalSource(make(chan os.Signal)), WithCleanExitErrors(errDone))
+	err := ww.ExecContext(context.Background(), func(context.Context) error {
+		return fmt.Errorf("wrapped: %w", errDone)
+	})
+	if err != nil {
+		t.Errorf("ExecContext returned %v for a wrapped clean exit error, expected no error", err)
+	}
+
+	// the errors are configured per wrapper
+	ww = RegisterSignalHandlers(DefaultSignalHandlers(), WithSignalSource(make(chan os.Signal)))
+	if code := ww.Exec(func() error { return errDone }); code != 1 {
+		t.Errorf("Exec returned %d without WithCleanExitErrors, expected 1", code)
+	}
+}
+
+func TestSerialHandlers(t *testing.T) {
+	src := make(chan os.Signal, 2)
+	running, overlapped := int32(0), int32(0)
+	handled := make(chan struct{}, 2)
+	ww := RegisterSignalHandlers(SignalHandlers{
+		syscall.SIGHUP: func(chan int) {
+			if atomic.AddInt32(&running, 1) > 1 {
+				atomic.StoreInt32(&overlapped, 1)
+			}
+			time.Sleep(50 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			handled <- struct{}{}
+		},
+		syscall.SIGTERM: exitCleanly,
+	}, WithSignalSource(src))
+	done := execAsync(ww, context.Background(), waitCtx)
+
+	src <- syscall.SIGHUP
+	src <- syscall.SIGHUP
+	for i := 0; i < 2; i++ {
+		select {
+		case <-handled:
+		case <-time.After(testTimeout):
+			t.Fatalf("the handler has been executed %d times, expected 2", i)
+		}
+	}
+	// the handlers ending the execution still do so
+	send(t, src, syscall.SIGTERM)
+	if err := result(t, done); err != nil {
+		t.Errorf("ExecContext returned %v, expected no error", err)
+	}
+	if atomic.LoadInt32(&overlapped) != 0 {
+		t.Errorf("the executions of the handler overlapped")
+	}
+}
+
+func TestWithSignalObserver(t *testing.T) {
+	src := make(chan os.Signal)
+	var observed []os.Signal
+	ww := RegisterSignalHandlers(SignalHandlers{
+		syscall.SIGHUP:  func(chan int) {},
+		syscall.SIGTERM: exitCleanly,
+	}, WithSignalSource(src), WithDebounce(syscall.SIGHUP, time.Minute), WithSignalObserver(func(sig os.Signal) {
+		observed = append(observed, sig)
+	}))
+	done := execAsync(ww, context.Background(), waitCtx)
+
+	// the second SIGHUP is debounced, and SIGQUIT has no handler
+	delivered := []os.Signal{syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGHUP, syscall.SIGTERM}
+	for _, sig := range delivered {
+		send(t, src, sig)
+	}
+	if err := result(t, done); err != nil {
+		t.Errorf("ExecContext returned %v, expected no error", err)
+	}
+	if fmt.Sprint(observed) != fmt.Sprint(delivered) {
+		t.Errorf("the observer received %v, expected %v", observed, delivered)
+	}
+}
+
+func TestWithDefaultHandler(t *testing.T) {
+	src := make(chan os.Signal)
+	explicit, fallback := make(chan os.Signal, 1), make(chan os.Signal, 1)
+	ww := RegisterSignalHandlers(SignalHandlers{
+		syscall.SIGHUP: func(chan int) {
+			explicit <- syscall.SIGHUP
+		},
+		syscall.SIGTERM: exitCleanly,
+	}, WithSignalSource(src), WithDefaultHandler(func(sig os.Signal, _ chan int) {
+		fallback <- sig
+	}, syscall.SIGQUIT))
+	done := execAsync(ww, context.Background(), waitCtx)
+
+	send(t, src, syscall.SIGQUIT)
+	if sig := <-fallback; sig != syscall.SIGQUIT {
+		t.Errorf("the default handler received %s, expected %s", sig, syscall.SIGQUIT)
+	}
+	send(t, src, syscall.SIGHUP)
+	<-explicit
+	send(t, src, syscall.SIGTERM)
+	if err := result(t, done); err != nil {
+		t.Errorf("ExecContext returned %v, expected no error", err)
+	}
+	if len(fallback) > 0 {
+		t.Errorf("the default handler received %s, which has its own handler", <-fallback)
+	}
+}
+
+func TestRegisterSignalHandlersErr(t *testing.T) {
+	if _, err := RegisterSignalHandlersErr(SignalHandlers{syscall.SIGHUP: nil, syscall.SIGTERM: exitCleanly}); err == nil {
+		t.Errorf("RegisterSignalHandlersErr succeeded with a nil handler")
+	}
+	if _, err := RegisterSignalHandlersErr(SignalHandlers{}); err == nil {
+		t.Errorf("RegisterSignalHandlersErr succeeded without handlers")
+	}
+
+	src := make(chan os.Signal)
+	ww, err := RegisterSignalHandlersErr(DefaultSignalHandlers(), WithSignalSource(src))
+	if err != nil {
+		t.Fatalf("RegisterSignalHandlersErr returned %v, expected no error", err)
+	}
+	done := execAsync(ww, context.Background(), waitCtx)
+	send(t, src, syscall.SIGTERM)
+	if err = result(t, done); err != nil {
+		t.Errorf("ExecContext returned %v, expected no error", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	errFatal := errors.New("fatal")
+	ww := RegisterSignalHandlers(DefaultSignalHandlers(), WithSignalSource(make(chan os.Signal)))
+	cleaned := false
+	err := ww.ExecContext(context.Background(), func(ctx context.Context) error {
+		for i := 0; ; i++ {
+			if i == 3 {
+				ww.Shutdown(errFatal)
+			}
+			select {
+			case <-ctx.Done():
+				// the function keeps running until its context is canceled, so it can clean up
+				cleaned = true
+				return ctx.Err()
+			case <-time.After(time.Millisecond):
+			}
+		}
+	})
+	if !errors.Is(err, errFatal) {
+		t.Errorf("ExecContext returned %v, expected %v", err, errFatal)
+	}
+	if errors.Is(err, context.Canceled) {
+		t.Errorf("ExecContext returned %v, which includes the cancellation of the function", err)
+	}
+	if !cleaned {
+		t.Errorf("the function returned before its context got canceled")
+	}
+
+	ww = RegisterSignalHandlers(DefaultSignalHandlers(), WithSignalSource(make(chan os.Signal)))
+	err = ww.ExecContext(context.Background(), func(ctx context.Context) error {
+		ww.Shutdown(nil)
+		return waitCtx(ctx)
+	})
+	if err != nil {
+		t.Errorf("ExecContext returned %v after a clean shutdown, expected no error", err)
+	}
+}
+
+// testLogger records the lines logged with Printf
+type testLogger struct {
+	m     sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, args ...interface{}) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func TestWithLogger(t *testing.T) {
+	src := make(chan os.Signal)
+	logger := &testLogger{}
+	ww := RegisterSignalHandlers(DefaultSignalHandlers(), WithSignalSource(src), WithLogger(logger))
+	done := execAsync(ww, context.Background(), waitCtx)
+	send(t, src, syscall.SIGTERM)
+	if err := result(t, done); err != nil {
+		t.Errorf("ExecContext returned %v, expected no error", err)
+	}
+
+	logger.m.Lock()
+	defer logger.m.Unlock()
+	expected := []string{
+		"received signal " + syscall.SIGTERM.String(),
+		"executing the handler for signal " + syscall.SIGTERM.String(),
+		"exiting with status 0 pushed by a signal handler",
+	}
+	log := strings.Join(logger.lines, "\n")
+	for _, line := range expected {
+		if !strings.Contains(log, line) {
+			t.Errorf("the log doesn't contain %q:\n%s", line, log)
+		}
+	}
+}
+
+func TestSimpleHandlerContextCanceled(t *testing.T) {
+	src := make(chan os.Signal)
+	errFail := errors.New("fail")
+	started, canceled := make(chan struct{}), make(chan error, 1)
+	ww := RegisterSimpleHandlers(SimpleHandlers{
+		syscall.SIGHUP: func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			canceled <- ctx.Err()
+			return nil
+		},
+	}, WithSignalSource(src))
+
+	// the execution ends for another reason while the handler is running
+	err := ww.ExecContext(context.Background(), func(ctx context.Context) error {
+		src <- syscall.SIGHUP
+		<-started
+		return errFail
+	})
+	if !errors.Is(err, errFail) {
+		t.Errorf("ExecContext returned %v, expected %v", err, errFail)
+	}
+	select {
+	case err = <-canceled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("the context of the handler ended with %v, expected %v", err, context.Canceled)
+		}
+	default:
+		t.Errorf("ExecContext returned before the handler")
+	}
+}
+
+func TestSimultaneousExits(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	exitWith := func(code int) handlerFn {
+		return func(status chan int) {
+			status <- code
+		}
+	}
+	for i := 0; i < 50; i++ {
+		src := make(chan os.Signal, 2)
+		ww := RegisterSignalHandlers(SignalHandlers{
+			syscall.SIGTERM: exitWith(3),
+			os.Interrupt:    exitWith(4),
+		}, WithSignalSource(src))
+		src <- syscall.SIGTERM
+		src <- os.Interrupt
+
+		var exit ExitError
+		if err := result(t, execAsync(ww, context.Background(), waitCtx)); !errors.As(err, &exit) || exit.Code != 3 {
+			t.Fatalf("ExecContext returned %v, expected the exit status 3 of the first signal", err)
+		}
+	}
+}
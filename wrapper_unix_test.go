@@ -0,0 +1,105 @@
+//go:build unix
+
+package wrapper
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// kill sends sig to the test process, which needs to have a handler for it registered
+func kill(t *testing.T, sig syscall.Signal) {
+	t.Helper()
+	if err := syscall.Kill(syscall.Getpid(), sig); err != nil {
+		t.Fatalf("unable to send %s: %s", sig, err)
+	}
+}
+
+func TestDefaultSignalHandlers(t *testing.T) {
+	for _, sig := range []syscall.Signal{syscall.SIGINT, syscall.SIGTERM} {
+		t.Run(sig.String(), func(t *testing.T) {
+			ww := RegisterSignalHandlers(DefaultSignalHandlers())
+			done := execAsync(ww, context.Background(), waitCtx)
+			kill(t, sig)
+			if err := result(t, done); err != nil {
+				t.Errorf("ExecContext returned %v, expected no error", err)
+			}
+		})
+	}
+}
+
+func TestDefaultHandlerSignals(t *testing.T) {
+	received := make(chan os.Signal, 1)
+	ww := RegisterSignalHandlers(SignalHandlers{}, WithDefaultHandler(func(sig os.Signal, status chan int) {
+		received <- sig
+		status <- 0
+	}, syscall.SIGUSR1))
+	done := execAsync(ww, context.Background(), waitCtx)
+	kill(t, syscall.SIGUSR1)
+	if err := result(t, done); err != nil {
+		t.Errorf("ExecContext returned %v, expected no error", err)
+	}
+	if sig := <-received; sig != syscall.SIGUSR1 {
+		t.Errorf("the default handler received %s, expected %s", sig, syscall.SIGUSR1)
+	}
+}
+
+func TestWithSignalSource(t *testing.T) {
+	src := make(chan os.Signal)
+	received := make(chan os.Signal, 2)
+	ww := RegisterSignalHandlersExt(SignalHandlersExt{
+		// the default action for SIGWINCH is to ignore it, so the test process survives it not being handled
+		syscall.SIGWINCH: func(sig os.Signal, _ chan int) {
+			received <- sig
+		},
+		syscall.SIGTERM: func(_ os.Signal, status chan int) {
+			status <- 0
+		},
+	}, WithSignalSource(src))
+	done := execAsync(ww, context.Background(), waitCtx)
+
+	// the signals sent to the process don't get to the handlers
+	kill(t, syscall.SIGWINCH)
+	send(t, src, syscall.SIGWINCH)
+	send(t, src, syscall.SIGTERM)
+	if err := result(t, done); err != nil {
+		t.Errorf("ExecContext returned %v, expected no error", err)
+	}
+	if len(received) != 1 {
+		t.Fatalf("the handler has been called %d times, expected only for the signal from the source", len(received))
+	}
+	if sig := <-received; sig != syscall.SIGWINCH {
+		t.Errorf("the handler received %s, expected %s", sig, syscall.SIGWINCH)
+	}
+}
+
+func TestNonTerminatingSignals(t *testing.T) {
+	src := make(chan os.Signal)
+	handled := make(chan os.Signal, 1)
+	handlers := DefaultSignalHandlers()
+	handlers[syscall.SIGWINCH] = func(chan int) {
+		handled <- syscall.SIGWINCH
+	}
+	handlers[syscall.SIGCONT] = func(chan int) {
+		handled <- syscall.SIGCONT
+	}
+	done := execAsync(RegisterSignalHandlers(handlers, WithSignalSource(src)), context.Background(), waitCtx)
+
+	for _, sig := range []os.Signal{syscall.SIGWINCH, syscall.SIGWINCH, syscall.SIGCONT, syscall.SIGWINCH} {
+		send(t, src, sig)
+		if h := <-handled; h != sig {
+			t.Errorf("the handler for %s has been executed, expected the one for %s", h, sig)
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("the execution ended with %v after handling %s", err, sig)
+		default:
+		}
+	}
+	send(t, src, os.Interrupt)
+	if err := result(t, done); err != nil {
+		t.Errorf("ExecContext returned %v after the interrupt, expected no error", err)
+	}
+}